@@ -0,0 +1,138 @@
+package quickjs
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// Bind exposes an arbitrary Go function to JavaScript. Arguments are converted
+// to the parameter types, with a TypeError naming the offending argument when
+// that fails; a leading *Context parameter receives the calling context.
+// Return values are converted back, several of them as an array, and a
+// trailing non-nil error is thrown as a JavaScript Error.
+//
+// Values among the arguments, including functions and symbols inside
+// interface{} parameters, are borrowed for the duration of the call; fn must
+// duplicate those it keeps. Returned Values are handed over to JavaScript,
+// except borrowed ones, which are duplicated so that fn may return its
+// arguments unchanged.
+func (ctx *Context) Bind(fn interface{}) (Value, error) {
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func || rv.IsNil() {
+		return ctx.Undefined(), errors.New("bind: value is not a function")
+	}
+
+	t := rv.Type()
+	name := funcName(rv)
+
+	params := make([]reflect.Type, t.NumIn())
+	for i := range params {
+		params[i] = t.In(i)
+	}
+
+	withContext := len(params) > 0 && params[0] == contextType
+	if withContext {
+		params = params[1:]
+	}
+
+	withError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+
+	length := len(params)
+	if t.IsVariadic() {
+		length--
+	}
+
+	return ctx.NamedFunction(name, length, func(ctx *Context, this Value, args []Value) Value {
+		in := make([]reflect.Value, 0, t.NumIn())
+		if withContext {
+			in = append(in, reflect.ValueOf(ctx))
+		}
+
+		borrowed := append([]Value(nil), args...)
+		exported := len(borrowed)
+		defer func() {
+			for _, v := range borrowed[exported:] {
+				v.Free()
+			}
+		}()
+
+		end := ctx.borrow(&borrowed)
+		defer end()
+
+		for i, param := range params {
+			if t.IsVariadic() && i == len(params)-1 {
+				for j := i; j < len(args); j++ {
+					arg, err := args[j].toGo(param.Elem())
+					if err != nil {
+						return ctx.ThrowTypeError("%s: argument %d: %v", name, j+1, err)
+					}
+					in = append(in, arg)
+				}
+				break
+			}
+
+			value := ctx.Undefined()
+			if i < len(args) {
+				value = args[i]
+			}
+
+			arg, err := value.toGo(param)
+			if err != nil {
+				return ctx.ThrowTypeError("%s: argument %d: %v", name, i+1, err)
+			}
+			in = append(in, arg)
+		}
+
+		end()
+		out := rv.Call(in)
+
+		if withError {
+			if err := out[len(out)-1]; !err.IsNil() {
+				return ctx.ThrowError(err.Interface().(error))
+			}
+			out = out[:len(out)-1]
+		}
+
+		switch len(out) {
+		case 0:
+			return ctx.Undefined()
+		case 1:
+			result, err := ctx.toJS(ctx.handOver(out[0], borrowed))
+			if err != nil {
+				return ctx.ThrowTypeError("%s: result: %v", name, err)
+			}
+			return result
+		}
+
+		results := make([]interface{}, len(out))
+		for i := range out {
+			results[i] = ctx.handOver(out[i], borrowed).Interface()
+		}
+
+		result, err := ctx.toJS(reflect.ValueOf(results))
+		if err != nil {
+			return ctx.ThrowTypeError("%s: result: %v", name, err)
+		}
+		return result
+	}), nil
+}
+
+// funcName returns the unqualified name of a Go function, or "" for function
+// literals.
+func funcName(rv reflect.Value) string {
+	fn := runtime.FuncForPC(rv.Pointer())
+	if fn == nil {
+		return ""
+	}
+
+	name := strings.TrimSuffix(fn.Name(), "-fm")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	if strings.HasPrefix(name, "func") && strings.Trim(name[len("func"):], "0123456789") == "" {
+		return ""
+	}
+	return name
+}
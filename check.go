@@ -0,0 +1,241 @@
+package quickjs
+
+/*
+#include <stdlib.h>
+#include "quickjs.h"
+
+// NewCheckContext creates a bare context for Check, parsing with the same
+// extensions as the contexts of NewContext.
+static JSContext *NewCheckContext(JSRuntime *rt) {
+	JSContext *ctx = JS_NewContext(rt);
+	if (ctx)
+		JS_EnableBignumExt(ctx, 1);
+	return ctx;
+}
+
+// CompileOnly compiles code without running it, returning -1 on exceptions.
+static int CompileOnly(JSContext *ctx, const char *code, size_t len, const char *filename, int eval_flags) {
+	JSValue val = JS_Eval(ctx, code, len, filename, eval_flags | JS_EVAL_FLAG_COMPILE_ONLY);
+	if (JS_IsException(val))
+		return -1;
+	// compiled modules belong to the context, which frees them
+	if (JS_VALUE_GET_TAG(val) != JS_TAG_MODULE)
+		JS_FreeValue(ctx, val);
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// Diagnostic describes a syntax error found by Check.
+type Diagnostic struct {
+	Message  string
+	FileName string
+	// Line and Column are 1-based, and 0 if unknown.
+	Line   int
+	Column int
+	// Frame shows the lines around the error, with a caret under the
+	// offending token when its column is known. It is empty if the line is
+	// unknown.
+	Frame string
+}
+
+func (d *Diagnostic) String() string {
+	switch {
+	case d.Line == 0:
+		return fmt.Sprintf("%s: %s\n", d.FileName, d.Message)
+	case d.Column == 0:
+		return fmt.Sprintf("%s:%d: %s\n%s", d.FileName, d.Line, d.Message, d.Frame)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s\n%s", d.FileName, d.Line, d.Column, d.Message, d.Frame)
+}
+
+// Check compiles code as a script or, with EVAL_MODULE, as a module without
+// running it. It returns nil if the code is valid, and a diagnostic for the
+// first syntax error otherwise. Other failures, such as running out of
+// memory, are returned as errors. The code is compiled in a bare context of
+// the same runtime, freed right after, so checking a module does not register
+// it in ctx and no jobs or scripts run.
+//
+// QuickJS reports the line of syntax errors but not their column, which Check
+// finds by compiling the code up to each token of the line in turn.
+func (ctx *Context) Check(code, filename string, evaltype int) (*Diagnostic, error) {
+	ref := C.NewCheckContext(C.JS_GetRuntime(ctx.ref))
+	if ref == nil {
+		return nil, errors.New("check: error creating a context")
+	}
+	scratch := &Context{ref: ref}
+	defer scratch.Free()
+
+	filenamePtr := C.CString(filename)
+	defer C.free(unsafe.Pointer(filenamePtr))
+
+	jsErr, err := scratch.compileOnly(code, filenamePtr, evaltype)
+	if jsErr == nil {
+		return nil, err
+	}
+
+	d := &Diagnostic{Message: jsErr.Message, FileName: filename, Line: jsErr.Line, Column: jsErr.Column}
+	lines := strings.Split(code, "\n")
+	if d.Line < 1 || d.Line > len(lines) {
+		d.Line, d.Column = 0, 0
+		return d, nil
+	}
+	if d.Column == 0 {
+		d.Column = scratch.errorColumn(code, lines, d, filenamePtr, evaltype)
+	}
+	d.Frame = codeFrame(lines, d.Line, d.Column)
+	return d, nil
+}
+
+// compileOnly compiles code, returning the syntax error it has if any, or
+// the error which kept it from being compiled.
+func (ctx *Context) compileOnly(code string, filename *C.char, evaltype int) (*Error, error) {
+	codePtr := C.CString(code)
+	defer C.free(unsafe.Pointer(codePtr))
+
+	if C.CompileOnly(ctx.ref, codePtr, C.size_t(len(code)), filename, C.int(evaltype)) == 0 {
+		return nil, nil
+	}
+
+	err := ctx.Exception()
+	var jsErr *Error
+	if !errors.Is(err, ErrSyntaxError) || !errors.As(err, &jsErr) {
+		return nil, err
+	}
+	return jsErr, err
+}
+
+// errorColumn finds the column of the token d was reported at. QuickJS reports
+// syntax errors at the current token, so the code is compiled up to the end
+// of each token of the line in turn, until it fails with the same error on
+// the same line. A newline is appended to each prefix, so that errors at its
+// end are reported on the next line instead.
+func (ctx *Context) errorColumn(code string, lines []string, d *Diagnostic, filename *C.char, evaltype int) int {
+	start := 0
+	for _, line := range lines[:d.Line-1] {
+		start += len(line) + 1
+	}
+
+	line := lines[d.Line-1]
+	for _, token := range lineTokens(line) {
+		jsErr, _ := ctx.compileOnly(code[:start+token.end]+"\n", filename, evaltype)
+		if jsErr != nil && jsErr.Line == d.Line && jsErr.Message == d.Message {
+			return utf8.RuneCountInString(line[:token.start]) + 1
+		}
+	}
+	return 0
+}
+
+type tokenSpan struct{ start, end int }
+
+// punctuators lists the JavaScript punctuators of more than one character,
+// longest first.
+var punctuators = []string{
+	">>>=", "...", "===", "!==", "**=", "<<=", ">>=", ">>>", "&&=", "||=", "??=",
+	"=>", "==", "!=", "<=", ">=", "&&", "||", "??", "?.", "++", "--", "+=", "-=",
+	"*=", "/=", "%=", "&=", "|=", "^=", "<<", ">>", "**",
+}
+
+// lineTokens splits a line of JavaScript into tokens, roughly: it only has to
+// find where the tokens a syntax error can be reported at end.
+func lineTokens(line string) []tokenSpan {
+	var tokens []tokenSpan
+	for i := 0; i < len(line); {
+		c := line[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case strings.HasPrefix(line[i:], "//"):
+			i = len(line)
+		case strings.HasPrefix(line[i:], "/*"):
+			if end := strings.Index(line[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(line)
+			}
+		case c == '"' || c == '\'' || c == '`':
+			for i++; i < len(line) && line[i] != c; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		case isWordByte(c):
+			for i < len(line) && isWordByte(line[i]) {
+				i++
+			}
+		default:
+			i++
+			for _, p := range punctuators {
+				if strings.HasPrefix(line[start:], p) {
+					i = start + len(p)
+					break
+				}
+			}
+		}
+		if i > len(line) {
+			i = len(line)
+		}
+		tokens = append(tokens, tokenSpan{start, i})
+	}
+	return tokens
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// codeFrame renders the lines around line, marking it and, if column is
+// known, pointing a caret at the column.
+func codeFrame(lines []string, line, column int) string {
+	const around = 2
+
+	first, last := line-around, line+around
+	if first < 1 {
+		first = 1
+	}
+	if last > len(lines) {
+		last = len(lines)
+	}
+	width := len(fmt.Sprint(last))
+
+	var b strings.Builder
+	for n := first; n <= last; n++ {
+		text := strings.TrimRight(lines[n-1], "\r")
+		marker := " "
+		if n == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "%s %*d | %s\n", marker, width, n, text)
+
+		if n == line && column > 0 {
+			// tabs are kept so that the caret lines up with the code
+			var pad strings.Builder
+			for i, r := range []rune(text) {
+				if i >= column-1 {
+					break
+				}
+				if r == '\t' {
+					pad.WriteRune('\t')
+				} else {
+					pad.WriteRune(' ')
+				}
+			}
+			fmt.Fprintf(&b, "  %*s | %s^\n", width, "", pad.String())
+		}
+	}
+	return b.String()
+}
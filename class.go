@@ -0,0 +1,423 @@
+package quickjs
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include "quickjs.h"
+
+extern JSValue classConstructor(JSContext *ctx, JSValueConst new_target, int argc, JSValueConst *argv, int magic);
+extern void classFinalizer(JSRuntime *rt, JSValue val);
+
+static int RegisterClass(JSContext *ctx, JSClassID class_id) {
+	JSRuntime *rt = JS_GetRuntime(ctx);
+	JSClassDef def = { .class_name = "GoObject", .finalizer = classFinalizer };
+	if (JS_IsRegisteredClass(rt, class_id))
+		return 0;
+	return JS_NewClass(rt, class_id, &def);
+}
+
+static JSValue NewClassConstructor(JSContext *ctx, const char *name, int length, int magic) {
+	return JS_NewCFunction2(ctx, (JSCFunction *)classConstructor, name, length, JS_CFUNC_constructor_magic, magic);
+}
+
+static JSValue NewClassInstance(JSContext *ctx, JSValueConst proto, JSClassID class_id, int64_t id) {
+	JSValue obj = JS_NewObjectProtoClass(ctx, proto, class_id);
+	if (!JS_IsException(obj))
+		JS_SetOpaque(obj, (void *)(intptr_t)id);
+	return obj;
+}
+
+static int64_t InstanceID(JSValueConst obj, JSClassID class_id) {
+	return (int64_t)(intptr_t)JS_GetOpaque(obj, class_id);
+}
+
+static JSValue ThrowReleasedClass(JSContext *ctx) { return JS_ThrowTypeError(ctx, "class has been released"); }
+static JSValue ClassException() { return JS_EXCEPTION; }
+*/
+import "C"
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"unsafe"
+)
+
+type ClassMethod func(ctx *Context, this interface{}, args []Value) Value
+
+type ClassProperty struct {
+	Get func(ctx *Context, this interface{}) Value
+	Set func(ctx *Context, this interface{}, value Value) error
+}
+
+// ClassSpec describes a JavaScript class whose instances are backed by Go
+// values. Constructor creates the Go value for `new`; without it the class
+// can only be instantiated from Go. Finalizer is called with the Go value once
+// the instance is garbage collected.
+type ClassSpec struct {
+	Name        string
+	Constructor func(ctx *Context, args []Value) (interface{}, error)
+	Methods     map[string]ClassMethod
+	Properties  map[string]ClassProperty
+	Static      map[string]Function
+	Finalizer   func(this interface{})
+}
+
+type Class struct {
+	ctx   *Context
+	slot  int
+	spec  ClassSpec
+	ctor  Value
+	proto Value
+}
+
+type classInstance struct {
+	class *Class
+	value interface{}
+}
+
+// goClassID is the class id shared by the instances of all classes defined
+// from Go. QuickJS never reuses class ids, so a single one is allocated for
+// the process and registered in every runtime; the class of an instance is
+// recorded in the Go value its opaque slot refers to.
+var goClassID struct {
+	sync.Once
+	id C.JSClassID
+}
+
+func instanceClassID() C.JSClassID {
+	goClassID.Do(func() { C.JS_NewClassID(&goClassID.id) })
+	return goClassID.id
+}
+
+// magicSlots maps the magic numbers of native constructors to Go values.
+// QuickJS stores magic numbers in 16 bits, too few for an ObjectId.
+var magicSlots struct {
+	sync.RWMutex
+	values []interface{}
+	free   []int
+}
+
+func newMagicSlot(v interface{}) (int, error) {
+	magicSlots.Lock()
+	defer magicSlots.Unlock()
+
+	if n := len(magicSlots.free); n > 0 {
+		slot := magicSlots.free[n-1]
+		magicSlots.free = magicSlots.free[:n-1]
+		magicSlots.values[slot] = v
+		return slot, nil
+	}
+
+	if len(magicSlots.values) == 0 {
+		// slot 0 is never used, so that a zero magic is always invalid
+		magicSlots.values = append(magicSlots.values, nil)
+	}
+	if len(magicSlots.values) > math.MaxInt16 {
+		return 0, errors.New("too many native constructors")
+	}
+	magicSlots.values = append(magicSlots.values, v)
+	return len(magicSlots.values) - 1, nil
+}
+
+func magicSlot(magic C.int) (interface{}, bool) {
+	magicSlots.RLock()
+	defer magicSlots.RUnlock()
+
+	if magic <= 0 || int(magic) >= len(magicSlots.values) || magicSlots.values[magic] == nil {
+		return nil, false
+	}
+	return magicSlots.values[magic], true
+}
+
+func freeMagicSlot(slot int) {
+	magicSlots.Lock()
+	defer magicSlots.Unlock()
+
+	if slot <= 0 || slot >= len(magicSlots.values) || magicSlots.values[slot] == nil {
+		return
+	}
+	magicSlots.values[slot] = nil
+	magicSlots.free = append(magicSlots.free, slot)
+}
+
+// DefineClass registers a class in the context's runtime and binds its
+// constructor to the global object under spec.Name.
+func (ctx *Context) DefineClass(spec ClassSpec) (*Class, error) {
+	if spec.Name == "" {
+		return nil, errors.New("class must have a name")
+	}
+
+	namePtr := C.CString(spec.Name)
+	defer C.free(unsafe.Pointer(namePtr))
+
+	if C.RegisterClass(ctx.ref, instanceClassID()) < 0 {
+		return nil, errors.New("error registering the class")
+	}
+
+	class := &Class{ctx: ctx, spec: spec}
+
+	slot, err := newMagicSlot(class)
+	if err != nil {
+		return nil, err
+	}
+	class.slot = slot
+
+	class.ctor = Value{ctx: ctx, ref: C.NewClassConstructor(ctx.ref, namePtr, 0, C.int(class.slot))}
+	if class.ctor.IsException() {
+		freeMagicSlot(class.slot)
+		return nil, ctx.Exception()
+	}
+	class.proto = ctx.Object()
+
+	for name, method := range spec.Methods {
+		if err := defineMethod(class.proto, name, ctx.NamedFunction(name, 0, class.method(method))); err != nil {
+			class.free()
+			return nil, err
+		}
+	}
+
+	for name, prop := range spec.Properties {
+		if err := class.defineProperty(name, prop); err != nil {
+			class.free()
+			return nil, err
+		}
+	}
+
+	for name, fn := range spec.Static {
+		if err := defineMethod(class.ctor, name, ctx.NamedFunction(name, 0, fn)); err != nil {
+			class.free()
+			return nil, err
+		}
+	}
+
+	if err := class.defineStringTag(); err != nil {
+		class.free()
+		return nil, err
+	}
+
+	C.JS_SetConstructor(ctx.ref, class.ctor.ref, class.proto.ref)
+
+	if err := ctx.Globals().Set(spec.Name, ctx.DupValue(class.ctor)); err != nil {
+		class.free()
+		return nil, err
+	}
+
+	ctx.classes = append(ctx.classes, class)
+	return class, nil
+}
+
+func (c *Class) Name() string { return c.spec.Name }
+
+// Constructor returns the constructor function. It must not be freed.
+func (c *Class) Constructor() Value { return c.ctor }
+
+// Prototype returns the prototype of the instances. It must not be freed.
+func (c *Class) Prototype() Value { return c.proto }
+
+// NewInstance creates an instance backed by value without calling the
+// constructor.
+func (c *Class) NewInstance(value interface{}) (Value, error) {
+	return c.newInstance(c.proto, value)
+}
+
+// Unwrap returns the Go value backing v, if v is an instance of the class.
+func (c *Class) Unwrap(v Value) (interface{}, bool) {
+	instance, ok := c.instance(v)
+	if !ok {
+		return nil, false
+	}
+	return instance.value, true
+}
+
+func (c *Class) instance(v Value) (*classInstance, bool) {
+	id := instanceID(v.ref)
+	if id.IsNil() {
+		return nil, false
+	}
+	value, ok := id.Get()
+	if !ok {
+		return nil, false
+	}
+	instance := value.(*classInstance)
+	return instance, instance.class == c
+}
+
+func (c *Class) newInstance(proto Value, value interface{}) (Value, error) {
+	id := NewObjectId(&classInstance{class: c, value: value})
+
+	obj := Value{ctx: c.ctx, ref: C.NewClassInstance(c.ctx.ref, proto.ref, instanceClassID(), C.int64_t(id))}
+	if obj.IsException() {
+		id.Free()
+		return obj, c.ctx.Exception()
+	}
+	return obj, nil
+}
+
+// receiver returns the Go value backing this, throwing a TypeError into the
+// context if this is not an instance of the class.
+func (c *Class) receiver(ctx *Context, this Value) (interface{}, bool) {
+	instance, ok := c.instance(this)
+	if !ok {
+		ctx.ThrowTypeError("%s object expected", c.spec.Name)
+		return nil, false
+	}
+	return instance.value, true
+}
+
+func (c *Class) method(method ClassMethod) Function {
+	return func(ctx *Context, this Value, args []Value) Value {
+		value, ok := c.receiver(ctx, this)
+		if !ok {
+			return Value{ctx: ctx, ref: C.ClassException()}
+		}
+		return method(ctx, value, args)
+	}
+}
+
+// defineMethod defines fn as a non-enumerable method of obj, as class syntax
+// does, and frees it.
+func defineMethod(obj Value, name string, fn Value) error {
+	defer fn.Free()
+
+	return obj.DefineProperty(name, PropertyDescriptor{
+		Value:          &fn,
+		IsWritable:     PropertyOption(true),
+		IsEnumerable:   PropertyOption(false),
+		IsConfigurable: PropertyOption(true),
+	})
+}
+
+func (c *Class) defineProperty(name string, prop ClassProperty) error {
+	desc := PropertyDescriptor{IsConfigurable: PropertyOption(true), IsEnumerable: PropertyOption(false)}
+
+	if prop.Get != nil {
+		getter := c.ctx.NamedFunction(name, 0, func(ctx *Context, this Value, args []Value) Value {
+			value, ok := c.receiver(ctx, this)
+			if !ok {
+				return Value{ctx: ctx, ref: C.ClassException()}
+			}
+			return prop.Get(ctx, value)
+		})
+		defer getter.Free()
+		desc.Getter = &getter
+	}
+
+	if prop.Set != nil {
+		setter := c.ctx.NamedFunction(name, 1, func(ctx *Context, this Value, args []Value) Value {
+			value, ok := c.receiver(ctx, this)
+			if !ok {
+				return Value{ctx: ctx, ref: C.ClassException()}
+			}
+			arg := ctx.Undefined()
+			if len(args) > 0 {
+				arg = args[0]
+			}
+			if err := prop.Set(ctx, value, arg); err != nil {
+				return ctx.ThrowError(err)
+			}
+			return ctx.Undefined()
+		})
+		defer setter.Free()
+		desc.Setter = &setter
+	}
+
+	return c.proto.DefineProperty(name, desc)
+}
+
+// defineStringTag makes Object.prototype.toString report the class name.
+func (c *Class) defineStringTag() error {
+	key := c.ctx.SymbolToStringTag()
+	defer key.Free()
+
+	atom := key.Atom()
+	defer atom.Free()
+
+	name := c.ctx.String(c.spec.Name)
+	defer name.Free()
+
+	return c.proto.DefinePropertyByAtom(atom, PropertyDescriptor{
+		IsConfigurable: PropertyOption(true),
+		IsEnumerable:   PropertyOption(false),
+		IsWritable:     PropertyOption(false),
+		Value:          &name,
+	})
+}
+
+func (c *Class) free() {
+	c.ctor.Free()
+	c.proto.Free()
+	freeMagicSlot(c.slot)
+}
+
+//export classConstructor
+func classConstructor(ctx *C.JSContext, newTarget C.JSValueConst, argc C.int, argv *C.JSValueConst, magic C.int) (result C.JSValue) {
+	v, ok := magicSlot(magic)
+	if !ok {
+		return C.ThrowReleasedClass(ctx)
+	}
+	class := v.(*Class)
+
+	loop := class.ctx.events()
+	loop.enter()
+	defer loop.leave()
+
+	defer catchPanic(func(r interface{}) {
+		result = class.ctx.throwPanic(r).ref
+	})
+
+	if class.spec.Constructor == nil {
+		return class.ctx.ThrowTypeError("%s can not be constructed", class.spec.Name).ref
+	}
+
+	refs := (*[1 << unsafe.Sizeof(0)]C.JSValueConst)(unsafe.Pointer(argv))[:argc:argc]
+	args := make([]Value, len(refs))
+	for i := range args {
+		args[i] = Value{ctx: class.ctx, ref: refs[i]}
+	}
+
+	value, err := class.spec.Constructor(class.ctx, args)
+	if err != nil {
+		return class.ctx.ThrowError(err).ref
+	}
+
+	// new.target differs from the constructor when a subclass is created
+	target := Value{ctx: class.ctx, ref: newTarget}
+	proto := target.Get("prototype")
+	if !proto.IsObject() {
+		proto.Free()
+		proto = class.ctx.DupValue(class.proto)
+	}
+	defer proto.Free()
+
+	obj, err := class.newInstance(proto, value)
+	if err != nil {
+		return class.ctx.ThrowError(err).ref
+	}
+	return obj.ref
+}
+
+//export classFinalizer
+func classFinalizer(rt *C.JSRuntime, val C.JSValue) {
+	id := instanceID(val)
+	defer id.Free()
+
+	v, ok := id.Get()
+	if !ok {
+		return
+	}
+
+	instance := v.(*classInstance)
+	if instance.class.spec.Finalizer != nil {
+		// a panic must not unwind through the garbage collector
+		defer func() { recover() }()
+		instance.class.spec.Finalizer(instance.value)
+	}
+}
+
+func instanceID(val C.JSValue) ObjectId {
+	if (Value{ref: val}).classID() != instanceClassID() {
+		return 0
+	}
+	return ObjectId(C.InstanceID(val, instanceClassID()))
+}
@@ -0,0 +1,121 @@
+package quickjs
+
+/*
+#include <stdlib.h>
+#include "quickjs.h"
+
+extern JSValue constructorProxy(JSContext *ctx, JSValueConst new_target, int argc, JSValueConst *argv, int magic);
+
+// NewConstructorFunc creates a function that can be called with or without
+// new, along with its prototype object.
+static JSValue NewConstructorFunc(JSContext *ctx, const char *name, int length, int magic) {
+	JSValue fn, proto;
+
+	fn = JS_NewCFunction2(ctx, (JSCFunction *)constructorProxy, name, length, JS_CFUNC_constructor_or_func_magic, magic);
+	if (JS_IsException(fn))
+		return fn;
+
+	proto = JS_NewObject(ctx);
+	if (JS_IsException(proto)) {
+		JS_FreeValue(ctx, fn);
+		return proto;
+	}
+	JS_SetConstructor(ctx, fn, proto);
+	JS_FreeValue(ctx, proto);
+	return fn;
+}
+
+static JSValue ThrowReleasedConstructor(JSContext *ctx) { return JS_ThrowInternalError(ctx, "go constructor has been released"); }
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// ConstructorFunction implements a function that may be called with new.
+// newTarget is the constructor new was applied to, which differs from the
+// function itself when a subclass is constructed, and undefined for plain
+// calls. Plain calls do not receive this.
+type ConstructorFunction func(ctx *Context, newTarget Value, args []Value) Value
+
+type constructorEntry struct {
+	ctx *Context
+	fn  ConstructorFunction
+}
+
+// Constructor creates a function calling fn that scripts can also invoke with
+// new and extend with class syntax. The function gets a fresh prototype
+// object; use ObjectFromTarget to create instances inheriting from it. The
+// function stays usable until the context is freed.
+func (ctx *Context) Constructor(name string, length int, fn ConstructorFunction) (Value, error) {
+	slot, err := newMagicSlot(&constructorEntry{ctx: ctx, fn: fn})
+	if err != nil {
+		return ctx.Undefined(), err
+	}
+
+	namePtr := C.CString(name)
+	defer C.free(unsafe.Pointer(namePtr))
+
+	val := Value{ctx: ctx, ref: C.NewConstructorFunc(ctx.ref, namePtr, C.int(length), C.int(slot))}
+	if val.IsException() {
+		freeMagicSlot(slot)
+		return val, ctx.Exception()
+	}
+
+	ctx.constructors = append(ctx.constructors, slot)
+	return val, nil
+}
+
+// ObjectFromTarget creates an ordinary object whose prototype is the
+// prototype property of newTarget, as the default constructor of a class
+// does. It falls back to Object.prototype if that property is not an object.
+func (ctx *Context) ObjectFromTarget(newTarget Value) (Value, error) {
+	proto := ctx.Undefined()
+	if newTarget.IsObject() {
+		proto = newTarget.Get("prototype")
+	}
+	defer proto.Free()
+
+	if !proto.IsObject() {
+		return ctx.Object(), nil
+	}
+
+	obj := Value{ctx: ctx, ref: C.JS_NewObjectProto(ctx.ref, proto.ref)}
+	if obj.IsException() {
+		return obj, ctx.Exception()
+	}
+	return obj, nil
+}
+
+func (ctx *Context) freeConstructors() {
+	for _, slot := range ctx.constructors {
+		freeMagicSlot(slot)
+	}
+	ctx.constructors = nil
+}
+
+//export constructorProxy
+func constructorProxy(ctx *C.JSContext, newTarget C.JSValueConst, argc C.int, argv *C.JSValueConst, magic C.int) (result C.JSValue) {
+	v, ok := magicSlot(magic)
+	if !ok {
+		return C.ThrowReleasedConstructor(ctx)
+	}
+	entry := v.(*constructorEntry)
+
+	loop := entry.ctx.events()
+	loop.enter()
+	defer loop.leave()
+
+	defer catchPanic(func(r interface{}) {
+		result = entry.ctx.throwPanic(r).ref
+	})
+
+	refs := (*[1 << unsafe.Sizeof(0)]C.JSValueConst)(unsafe.Pointer(argv))[:argc:argc]
+	args := make([]Value, len(refs))
+	for i := range args {
+		args[i] = Value{ctx: entry.ctx, ref: refs[i]}
+	}
+
+	return entry.fn(entry.ctx, Value{ctx: entry.ctx, ref: newTarget}, args).ref
+}
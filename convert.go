@@ -0,0 +1,560 @@
+package quickjs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	valueType   = reflect.TypeOf(Value{})
+	contextType = reflect.TypeOf((*Context)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	bigIntType  = reflect.TypeOf((*big.Int)(nil))
+	bigFltType  = reflect.TypeOf((*big.Float)(nil))
+)
+
+// retainedValues holds JavaScript values referenced from Go, such as functions
+// converted to Go callbacks. Go finalizers may run on any goroutine, so they
+// only queue values, which are freed later on the owner thread.
+type retainedValues struct {
+	values map[int64]Value
+	next   int64
+
+	sync.Mutex
+	released []int64
+}
+
+type retainedValue struct {
+	ctx *Context
+	id  int64
+}
+
+func (ctx *Context) retain(v Value) *retainedValue {
+	ctx.releaseValues()
+
+	if ctx.retained == nil {
+		ctx.retained = &retainedValues{values: make(map[int64]Value)}
+	}
+	ctx.retained.next++
+	ctx.retained.values[ctx.retained.next] = ctx.DupValue(v)
+
+	handle := &retainedValue{ctx: ctx, id: ctx.retained.next}
+	runtime.SetFinalizer(handle, func(handle *retainedValue) {
+		handle.ctx.retained.Lock()
+		handle.ctx.retained.released = append(handle.ctx.retained.released, handle.id)
+		handle.ctx.retained.Unlock()
+	})
+	return handle
+}
+
+func (h *retainedValue) Value() Value { return h.ctx.retained.values[h.id] }
+
+func (ctx *Context) releaseValues() {
+	if ctx.retained == nil {
+		return
+	}
+
+	ctx.retained.Lock()
+	released := ctx.retained.released
+	ctx.retained.released = nil
+	ctx.retained.Unlock()
+
+	for _, id := range released {
+		if v, ok := ctx.retained.values[id]; ok {
+			v.Free()
+			delete(ctx.retained.values, id)
+		}
+	}
+}
+
+func (ctx *Context) freeRetainedValues() {
+	if ctx.retained == nil {
+		return
+	}
+
+	for id, v := range ctx.retained.values {
+		v.Free()
+		delete(ctx.retained.values, id)
+	}
+}
+
+// fieldName returns the JavaScript name of an exported struct field, honouring
+// `js` and then `json` tags.
+func fieldName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" || field.Anonymous {
+		return "", false
+	}
+	for _, key := range []string{"js", "json"} {
+		if tag, ok := field.Tag.Lookup(key); ok {
+			name := strings.Split(tag, ",")[0]
+			if name == "-" {
+				return "", false
+			}
+			if name != "" {
+				return name, true
+			}
+		}
+	}
+	return field.Name, true
+}
+
+// toJS converts a Go value to a new JavaScript value, which the caller owns.
+// Values of type Value are passed through, handing their ownership over.
+func (ctx *Context) toJS(rv reflect.Value) (Value, error) {
+	if !rv.IsValid() {
+		return ctx.Null(), nil
+	}
+
+	switch rv.Type() {
+	case valueType:
+		return rv.Interface().(Value), nil
+	case bigIntType:
+		if rv.IsNil() {
+			return ctx.Null(), nil
+		}
+		return ctx.BigInt(rv.Interface().(*big.Int))
+	case bigFltType:
+		if rv.IsNil() {
+			return ctx.Null(), nil
+		}
+		return ctx.BigFloat(rv.Interface().(*big.Float))
+	}
+	if rv.Type().Implements(errorType) && !((rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) && rv.IsNil()) {
+		return ctx.Error(rv.Interface().(error)), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return ctx.Bool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return ctx.Int64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return ctx.Float64(float64(rv.Uint())), nil
+		}
+		return ctx.Int64(int64(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return ctx.Float64(rv.Float()), nil
+	case reflect.String:
+		return ctx.String(rv.String()), nil
+	case reflect.Interface, reflect.Ptr:
+		if rv.IsNil() {
+			return ctx.Null(), nil
+		}
+		return ctx.toJS(rv.Elem())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return ctx.Null(), nil
+		}
+		array := ctx.Array()
+		for i := 0; i < rv.Len(); i++ {
+			elem, err := ctx.toJS(rv.Index(i))
+			if err == nil {
+				err = array.SetByUint32(uint32(i), elem)
+			}
+			if err != nil {
+				array.Free()
+				return ctx.Undefined(), fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return array, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return ctx.Null(), nil
+		}
+		obj := ctx.Object()
+		iter := rv.MapRange()
+		for iter.Next() {
+			key := fmt.Sprint(iter.Key().Interface())
+			elem, err := ctx.toJS(iter.Value())
+			if err == nil {
+				err = obj.Set(key, elem)
+			}
+			if err != nil {
+				obj.Free()
+				return ctx.Undefined(), fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		return obj, nil
+	case reflect.Struct:
+		obj := ctx.Object()
+		for i := 0; i < rv.NumField(); i++ {
+			name, ok := fieldName(rv.Type().Field(i))
+			if !ok {
+				continue
+			}
+			elem, err := ctx.toJS(rv.Field(i))
+			if err == nil {
+				err = obj.Set(name, elem)
+			}
+			if err != nil {
+				obj.Free()
+				return ctx.Undefined(), fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return obj, nil
+	case reflect.Func:
+		if rv.IsNil() {
+			return ctx.Null(), nil
+		}
+		return ctx.Bind(rv.Interface())
+	}
+
+	return ctx.Undefined(), fmt.Errorf("unsupported type %s", rv.Type())
+}
+
+// toGo converts v to a Go value of type t. Values of type Value are passed
+// through without being duplicated.
+func (v Value) toGo(t reflect.Type) (reflect.Value, error) {
+	switch t {
+	case valueType:
+		return reflect.ValueOf(v), nil
+	case bigIntType:
+		if v.IsNull() || v.IsUndefined() {
+			return reflect.Zero(t), nil
+		}
+		val, err := v.BigInt()
+		return reflect.ValueOf(val), err
+	case bigFltType:
+		if v.IsNull() || v.IsUndefined() {
+			return reflect.Zero(t), nil
+		}
+		val, err := v.BigFloat()
+		return reflect.ValueOf(val), err
+	}
+
+	if rv, ok := v.goValue(); ok {
+		switch {
+		case rv.Type().AssignableTo(t):
+			return rv, nil
+		case rv.Kind() == reflect.Ptr && rv.Elem().Type().AssignableTo(t):
+			return rv.Elem(), nil
+		}
+	}
+
+	mismatch := func(expected string) (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("expected %s, got %s", expected, v.Type())
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if !v.IsBool() {
+			return mismatch("boolean")
+		}
+		return reflect.ValueOf(v.Bool()).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := v.integer()
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		rv := reflect.New(t).Elem()
+		if !i.IsInt64() || rv.OverflowInt(i.Int64()) {
+			return reflect.Value{}, fmt.Errorf("%s overflows %s", i, t)
+		}
+		rv.SetInt(i.Int64())
+		return rv, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := v.integer()
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		rv := reflect.New(t).Elem()
+		if !i.IsUint64() || rv.OverflowUint(i.Uint64()) {
+			return reflect.Value{}, fmt.Errorf("%s overflows %s", i, t)
+		}
+		rv.SetUint(i.Uint64())
+		return rv, nil
+	case reflect.Float32, reflect.Float64:
+		if !v.IsNumber() {
+			return mismatch("number")
+		}
+		return reflect.ValueOf(v.Float64()).Convert(t), nil
+	case reflect.String:
+		if !v.IsString() {
+			return mismatch("string")
+		}
+		return reflect.ValueOf(v.String()).Convert(t), nil
+	case reflect.Interface:
+		if v.IsNull() || v.IsUndefined() {
+			return reflect.Zero(t), nil
+		}
+		val, err := v.export()
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		rv := reflect.ValueOf(val)
+		if !rv.Type().AssignableTo(t) {
+			return reflect.Value{}, fmt.Errorf("%s is not assignable to %s", rv.Type(), t)
+		}
+		out := reflect.New(t).Elem()
+		out.Set(rv)
+		return out, nil
+	case reflect.Ptr:
+		if v.IsNull() || v.IsUndefined() {
+			return reflect.Zero(t), nil
+		}
+		elem, err := v.toGo(t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(t.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && (v.IsNull() || v.IsUndefined()) {
+			return reflect.Zero(t), nil
+		}
+		if !v.IsArray() {
+			return mismatch("array")
+		}
+		length := int(v.Len())
+		var rv reflect.Value
+		if t.Kind() == reflect.Slice {
+			rv = reflect.MakeSlice(t, length, length)
+		} else {
+			if length > t.Len() {
+				return reflect.Value{}, fmt.Errorf("array of length %d overflows %s", length, t)
+			}
+			rv = reflect.New(t).Elem()
+		}
+		for i := 0; i < length; i++ {
+			item := v.GetByUint32(uint32(i))
+			elem, err := item.toGoElem(t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("[%d]: %w", i, err)
+			}
+			rv.Index(i).Set(elem)
+		}
+		return rv, nil
+	case reflect.Map:
+		if v.IsNull() || v.IsUndefined() {
+			return reflect.Zero(t), nil
+		}
+		if !v.IsObject() {
+			return mismatch("object")
+		}
+		if t.Key().Kind() != reflect.String {
+			return reflect.Value{}, fmt.Errorf("unsupported map key type %s", t.Key())
+		}
+		names, err := v.PropertyNames()
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		rv := reflect.MakeMapWithSize(t, len(names))
+		for _, name := range names {
+			if !name.IsEnumerable {
+				continue
+			}
+			key := name.String()
+			item := v.Get(key)
+			elem, err := item.toGoElem(t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("%s: %w", key, err)
+			}
+			rv.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), elem)
+		}
+		return rv, nil
+	case reflect.Struct:
+		if !v.IsObject() {
+			return mismatch("object")
+		}
+		rv := reflect.New(t).Elem()
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := fieldName(t.Field(i))
+			if !ok {
+				continue
+			}
+			item := v.Get(name)
+			if item.IsUndefined() {
+				continue
+			}
+			elem, err := item.toGoElem(t.Field(i).Type)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("%s: %w", name, err)
+			}
+			rv.Field(i).Set(elem)
+		}
+		return rv, nil
+	case reflect.Func:
+		if v.IsNull() || v.IsUndefined() {
+			return reflect.Zero(t), nil
+		}
+		if !v.IsFunction() {
+			return mismatch("function")
+		}
+		return v.ctx.callback(v, t), nil
+	}
+
+	return reflect.Value{}, fmt.Errorf("unsupported type %s", t)
+}
+
+// toGoElem converts v, an element read from a larger value, taking over its
+// reference. Elements of type Value keep it, and are collected while a borrow
+// is active.
+func (v Value) toGoElem(t reflect.Type) (reflect.Value, error) {
+	if t == valueType {
+		if v.ctx.borrowed != nil {
+			*v.ctx.borrowed = append(*v.ctx.borrowed, v)
+		}
+		return reflect.ValueOf(v), nil
+	}
+
+	defer v.Free()
+	return v.toGo(t)
+}
+
+func (v Value) integer() (*big.Int, error) {
+	if !v.IsNumber() && !v.IsBigInt() {
+		return nil, fmt.Errorf("expected integer, got %s", v.Type())
+	}
+	return v.BigInt()
+}
+
+// export converts v to plain Go data: nil, bool, float64, string, *big.Int,
+// *big.Float, []interface{} and map[string]interface{}. Functions and symbols
+// are returned as duplicated Values, and objects created by Wrap, WrapMap or
+// WrapSlice as the Go data they expose. The duplicates are owned by the
+// caller, or collected for freeing while a borrow is active.
+func (v Value) export() (interface{}, error) {
+	if rv, ok := v.goValue(); ok {
+		return rv.Interface(), nil
+	}
+
+	switch v.Type() {
+	case TypeUndefined, TypeNull:
+		return nil, nil
+	case TypeBoolean:
+		return v.Bool(), nil
+	case TypeNumber:
+		return v.Float64(), nil
+	case TypeString:
+		return v.String(), nil
+	case TypeBigInt:
+		return v.BigInt()
+	case TypeBigFloat, TypeBigDecimal:
+		return v.BigFloat()
+	case TypeFunction, TypeSymbol:
+		val := v.ctx.DupValue(v)
+		if v.ctx.borrowed != nil {
+			*v.ctx.borrowed = append(*v.ctx.borrowed, val)
+		}
+		return val, nil
+	case TypeDate:
+		return v.String(), nil
+	}
+
+	// objects refer to themselves through their properties, which would
+	// convert forever
+	for _, outer := range v.ctx.exporting {
+		if outer.sameRef(v) {
+			return nil, errors.New("value is cyclic")
+		}
+	}
+	v.ctx.exporting = append(v.ctx.exporting, v)
+	defer func() { v.ctx.exporting = v.ctx.exporting[:len(v.ctx.exporting)-1] }()
+
+	if v.Type() == TypeArray {
+		rv, err := v.toGo(reflect.TypeOf([]interface{}{}))
+		if err != nil {
+			return nil, err
+		}
+		return rv.Interface(), nil
+	}
+
+	rv, err := v.toGo(reflect.TypeOf(map[string]interface{}{}))
+	if err != nil {
+		return nil, err
+	}
+	return rv.Interface(), nil
+}
+
+// borrow collects the Values export duplicates into borrowed until end is
+// called, for the caller to free once the Go code it converted the data for
+// is done with it.
+func (ctx *Context) borrow(borrowed *[]Value) (end func()) {
+	outer := ctx.borrowed
+	ctx.borrowed = borrowed
+	return func() { ctx.borrowed = outer }
+}
+
+// handOver prepares a result of Go code for toJS, which takes over the
+// Values passed to it. A Value the code only borrowed is duplicated first.
+func (ctx *Context) handOver(rv reflect.Value, borrowed []Value) reflect.Value {
+	if rv.Kind() == reflect.Interface && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() || rv.Type() != valueType {
+		return rv
+	}
+
+	v := rv.Interface().(Value)
+	for _, b := range borrowed {
+		if v == b {
+			return reflect.ValueOf(ctx.DupValue(v))
+		}
+	}
+	return rv
+}
+
+// callback wraps the JavaScript function fn as a Go function of type t. The
+// returned function must only be called on the context's owner thread, and
+// its caller owns the Values it returns.
+func (ctx *Context) callback(fn Value, t reflect.Type) reflect.Value {
+	handle := ctx.retain(fn)
+
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+
+		fail := func(err error) []reflect.Value {
+			if len(out) > 0 && t.Out(len(out)-1) == errorType {
+				out[len(out)-1] = reflect.ValueOf(&err).Elem()
+				return out
+			}
+			panic(err)
+		}
+
+		args := make([]Value, 0, len(in))
+		defer func() {
+			for _, arg := range args {
+				arg.Free()
+			}
+		}()
+
+		for i, arg := range in {
+			if arg.Type() == valueType {
+				arg = reflect.ValueOf(ctx.DupValue(arg.Interface().(Value)))
+			}
+			val, err := ctx.toJS(arg)
+			if err != nil {
+				return fail(fmt.Errorf("argument %d: %w", i+1, err))
+			}
+			args = append(args, val)
+		}
+
+		result, err := ctx.Call(ctx.Undefined(), handle.Value(), args)
+		if err != nil {
+			result.Free()
+			return fail(err)
+		}
+
+		if len(out) == 0 || t.Out(0) == errorType {
+			result.Free()
+		} else {
+			val, err := result.toGoElem(t.Out(0))
+			if err != nil {
+				return fail(fmt.Errorf("result: %w", err))
+			}
+			out[0] = val
+		}
+		return out
+	})
+}
@@ -0,0 +1,415 @@
+package quickjs
+
+/*
+#include "quickjs.h"
+
+static int SameRef(JSValueConst a, JSValueConst b) {
+	return JS_VALUE_GET_PTR(a) == JS_VALUE_GET_PTR(b);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// PanicError is returned when a Go function called from JavaScript panicked.
+// The panic is thrown into JavaScript as an InternalError, which carries the
+// Go stack in its goStack property.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string { return fmt.Sprintf("go panic: %v", p.Value) }
+
+func (p *PanicError) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+// SetRepanic makes errors caused by Go panics panic again once they reach the
+// Go caller, instead of being returned. This is mostly useful in tests.
+func (ctx *Context) SetRepanic(enabled bool) { ctx.repanic = enabled }
+
+func (ctx *Context) throwPanic(r interface{}) Value {
+	p, ok := r.(*PanicError)
+	if !ok {
+		p = &PanicError{Value: r, Stack: debug.Stack()}
+	}
+
+	ctor := ctx.intrinsic("InternalError")
+	defer ctor.Free()
+
+	message := ctx.String(p.Error())
+	defer message.Free()
+
+	obj, err := ctor.New(message)
+	if err != nil {
+		// the panic is still attached to the error thrown by the engine, so
+		// it reaches the Go caller as a PanicError
+		ctx.ThrowInternalError("%s", p.Error())
+		obj = Value{ctx: ctx, ref: C.JS_GetException(ctx.ref)}
+	}
+
+	obj.Set("goStack", ctx.String(string(p.Stack)))
+	ctx.attach(obj, p)
+
+	return ctx.Throw(obj)
+}
+
+// catchPanic hands a panic of Go code called back from C to handle, since a
+// panic must not unwind through the C frames of the interpreter. It must be
+// deferred directly.
+func catchPanic(handle func(r interface{})) {
+	if r := recover(); r != nil {
+		handle(r)
+	}
+}
+
+// attach associates data with the JavaScript object obj. The association is
+// kept in a WeakMap private to the bindings, through the WeakMap methods
+// captured with the context, so scripts can neither see nor intercept it.
+func (ctx *Context) attach(obj Value, data interface{}) error {
+	if !obj.IsObject() {
+		return errors.New("value is not an object")
+	}
+
+	if ctx.slots == nil {
+		ctor := ctx.intrinsic("WeakMap")
+		defer ctor.Free()
+
+		slots := Value{ctx: ctx, ref: C.JS_CallConstructor(ctx.ref, ctor.ref, 0, nil)}
+		if slots.IsException() {
+			return ctx.Exception()
+		}
+		ctx.slots = &slots
+	}
+
+	set := ctx.intrinsic("WeakMap.prototype.set")
+	defer set.Free()
+
+	handle := ctx.handle(data)
+	defer handle.Free()
+
+	result, err := ctx.Call(*ctx.slots, set, []Value{obj, handle})
+	result.Free()
+	return err
+}
+
+func (v Value) attached() (interface{}, bool) {
+	// nothing has been attached before the WeakMap exists
+	if !v.IsObject() || v.ctx.slots == nil {
+		return nil, false
+	}
+
+	get := v.ctx.intrinsic("WeakMap.prototype.get")
+	defer get.Free()
+
+	args := []C.JSValue{v.ref}
+	handle := Value{ctx: v.ctx, ref: C.JS_Call(v.ctx.ref, get.ref, v.ctx.slots.ref, 1, &args[0])}
+	defer handle.Free()
+
+	if handle.IsException() {
+		// Exception looks up attached data itself, so the failure is dropped
+		// here rather than taken through it
+		C.JS_FreeValue(v.ctx.ref, C.JS_GetException(v.ctx.ref))
+		return nil, false
+	}
+	return handle.handleObject()
+}
+
+// StackFrame is a frame of the stack of a JavaScript error. File is empty for
+// native functions, and Function for top-level code and parser errors.
+type StackFrame struct {
+	Function string
+	File     string
+	Line     int
+	Column   int
+}
+
+// parseStack parses the frames of a QuickJS stack trace, whose lines look like
+// "    at fn (file.js:3)", "    at fn (native)" or "    at file.js:3".
+func parseStack(stack string) []StackFrame {
+	var frames []StackFrame
+	for _, line := range strings.Split(stack, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "at ") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "at ")
+
+		var frame StackFrame
+		location := line
+		if i := strings.LastIndex(line, " ("); i >= 0 && strings.HasSuffix(line, ")") {
+			frame.Function = line[:i]
+			location = line[i+2 : len(line)-1]
+		}
+		if location != "native" {
+			frame.File, frame.Line, frame.Column = parseLocation(location)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// parseLocation splits "file:line" or "file:line:column".
+func parseLocation(location string) (file string, line, column int) {
+	file = location
+	var numbers []int
+	for len(numbers) < 2 {
+		i := strings.LastIndexByte(file, ':')
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(file[i+1:])
+		if err != nil {
+			break
+		}
+		numbers = append([]int{n}, numbers...)
+		file = file[:i]
+	}
+
+	switch len(numbers) {
+	case 1:
+		line = numbers[0]
+	case 2:
+		line, column = numbers[0], numbers[1]
+	}
+	return file, line, column
+}
+
+func (err *Error) locate(lineNumber Value) {
+	if lineNumber.IsNumber() {
+		err.Line = int(lineNumber.Int32())
+		return
+	}
+	for _, frame := range err.Frames {
+		if frame.File != "" && frame.Line > 0 {
+			err.Line, err.Column = frame.Line, frame.Column
+			return
+		}
+	}
+}
+
+// The built-in error classes. Errors returned for exceptions which are
+// instances of one of these classes, or of a subclass, match it with
+// errors.Is; use errors.As with *Error for the details.
+var (
+	ErrSyntaxError    = errors.New("SyntaxError")
+	ErrTypeError      = errors.New("TypeError")
+	ErrReferenceError = errors.New("ReferenceError")
+	ErrRangeError     = errors.New("RangeError")
+	ErrInternalError  = errors.New("InternalError")
+	ErrAggregateError = errors.New("AggregateError")
+)
+
+// Errors matching the InternalError exceptions QuickJS throws when a script
+// runs out of memory, overflows the stack, or is stopped by the interrupt
+// handler. They are matched by the state of the runtime during the call which
+// returned the exception rather than by the message, which scripts may throw
+// as well, so errors converted from values with Value.Error never match.
+var (
+	ErrOutOfMemory   = errors.New("out of memory")
+	ErrStackOverflow = errors.New("stack overflow")
+	ErrInterrupted   = errors.New("interrupted")
+)
+
+var errorClasses = []error{
+	ErrSyntaxError,
+	ErrTypeError,
+	ErrReferenceError,
+	ErrRangeError,
+	ErrInternalError,
+	ErrAggregateError,
+}
+
+// Is reports whether target is the built-in class of the error, or one of
+// ErrOutOfMemory, ErrStackOverflow and ErrInterrupted it stands for.
+func (err *Error) Is(target error) bool {
+	return target != nil && (target == err.class || target == err.internal)
+}
+
+// classify finds the built-in class v is an instance of, and the errors of
+// an AggregateError. It walks the prototype chain rather than running
+// instanceof, which could call a Symbol.hasInstance defined by scripts, and
+// compares it with the prototypes captured by the contexts of the runtime,
+// so that errors thrown in other contexts match as well. The walk stops at
+// proxies, whose getPrototypeOf trap would run.
+func (v Value) classify(err *Error) {
+	ctx := v.ctx
+
+	proto := ctx.DupValue(v)
+	for err.class == nil && proto.IsObject() && proto.classID() != classProxy {
+		next := Value{ctx: ctx, ref: C.JS_GetPrototype(ctx.ref, proto.ref)}
+		proto.Free()
+		proto = next
+		err.class = ctx.errorClassOf(proto)
+	}
+	proto.Free()
+
+	if err.class == ErrAggregateError {
+		err.Errors = v.aggregatedErrors()
+	}
+}
+
+// setInternal records the condition of the runtime err reports, if it is an
+// InternalError. The class may be unknown when memory is exhausted.
+func (err *Error) setInternal(conditions engineConditions) {
+	if err.class == nil || err.class == ErrInternalError {
+		err.internal = conditions.internalError(err.Cause)
+	}
+}
+
+// errorClassOf returns the built-in class proto is the prototype of, in this
+// or another context of the runtime.
+func (ctx *Context) errorClassOf(proto Value) error {
+	if !proto.IsObject() {
+		return nil
+	}
+
+	match := func(ctx *Context) error {
+		for _, class := range errorClasses {
+			if p, ok := ctx.intrinsics[class.Error()+".prototype"]; ok && C.SameRef(p.ref, proto.ref) != 0 {
+				return class
+			}
+		}
+		return nil
+	}
+
+	if ctx.intrinsics == nil {
+		// contexts not created by NewContext have not captured their
+		// intrinsics
+		for _, class := range errorClasses {
+			p := ctx.intrinsic(class.Error() + ".prototype")
+			if p.IsException() {
+				C.JS_FreeValue(ctx.ref, C.JS_GetException(ctx.ref))
+			}
+			same := p.IsObject() && C.SameRef(p.ref, proto.ref) != 0
+			p.Free()
+			if same {
+				return class
+			}
+		}
+	} else if class := match(ctx); class != nil {
+		return class
+	}
+
+	rt := C.JS_GetRuntime(ctx.ref)
+	contexts.RLock()
+	defer contexts.RUnlock()
+	for ref, other := range contexts.m {
+		if other != ctx && C.JS_GetRuntime(ref) == rt {
+			if class := match(other); class != nil {
+				return class
+			}
+		}
+	}
+	return nil
+}
+
+func (v Value) aggregatedErrors() []error {
+	errs := v.Get("errors")
+	defer errs.Free()
+
+	if !errs.IsArray() {
+		return nil
+	}
+
+	result := make([]error, errs.Len())
+	for i := range result {
+		item := errs.GetByUint32(uint32(i))
+		result[i] = item.Error()
+		item.Free()
+	}
+	return result
+}
+
+// ThrownValueError is returned for exceptions and promise rejections whose
+// value is not an Error object, as with throw "oops" or throw {code: 42}.
+type ThrownValueError struct {
+	// Value is the thrown value converted to plain Go data, so objects
+	// become map[string]interface{}. Functions and symbols are left out, and
+	// it is nil for values which can not be converted, such as cycles.
+	Value interface{}
+	// JSON is the JSON representation of the value, and empty for values
+	// without one such as undefined, functions and symbols.
+	JSON string
+	// Text is the value converted to a string.
+	Text string
+}
+
+func (e *ThrownValueError) Error() string {
+	if e.JSON != "" {
+		return "thrown " + e.JSON
+	}
+	return "thrown " + e.Text
+}
+
+// thrownValue converts a thrown value which is not an Error object.
+func (v Value) thrownValue() *ThrownValueError {
+	err := &ThrownValueError{Text: v.Type().String()}
+
+	if ptr := C.JS_ToCString(v.ctx.ref, v.ref); ptr != nil {
+		err.Text = C.GoString(ptr)
+		C.JS_FreeCString(v.ctx.ref, ptr)
+	} else {
+		// symbols and objects with a throwing toString can not be converted
+		C.JS_FreeValue(v.ctx.ref, C.JS_GetException(v.ctx.ref))
+	}
+
+	var borrowed []Value
+	end := v.ctx.borrow(&borrowed)
+	value, exportErr := v.export()
+	end()
+	if exportErr == nil {
+		err.Value = withoutValues(value)
+	} else {
+		// getters may have thrown
+		C.JS_FreeValue(v.ctx.ref, C.JS_GetException(v.ctx.ref))
+	}
+	for _, b := range borrowed {
+		b.Free()
+	}
+
+	undefined := v.ctx.Undefined()
+	text := Value{ctx: v.ctx, ref: C.JS_JSONStringify(v.ctx.ref, v.ref, undefined.ref, undefined.ref)}
+	defer text.Free()
+
+	switch {
+	case text.IsException():
+		// cycles and big integers can not be represented
+		C.JS_FreeValue(v.ctx.ref, C.JS_GetException(v.ctx.ref))
+	case text.IsString():
+		err.JSON = text.String()
+	}
+	return err
+}
+
+// withoutValues drops the functions and symbols export left as Values in x,
+// which must not outlive the conversion, like JSON leaves them out.
+func withoutValues(x interface{}) interface{} {
+	switch x := x.(type) {
+	case Value:
+		return nil
+	case []interface{}:
+		for i, elem := range x {
+			x[i] = withoutValues(elem)
+		}
+	case map[string]interface{}:
+		for key, elem := range x {
+			if _, ok := elem.(Value); ok {
+				delete(x, key)
+				continue
+			}
+			x[key] = withoutValues(elem)
+		}
+	}
+	return x
+}
+
+func (v Value) sameRef(other Value) bool { return C.SameRef(v.ref, other.ref) != 0 }
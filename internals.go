@@ -0,0 +1,498 @@
+package quickjs
+
+/*
+#include <stdlib.h>
+#include <stdint.h>
+#include <time.h>
+#if defined(__APPLE__)
+#include <malloc/malloc.h>
+#elif defined(__linux__) || defined(_WIN32)
+#include <malloc.h>
+#elif defined(__FreeBSD__)
+#include <malloc_np.h>
+#endif
+#include <sys/time.h>
+#ifndef _WIN32
+#include <sys/select.h>
+#endif
+#include "quickjs.h"
+
+// The definitions below mirror private parts of quickjs.c, which the public
+// API does not expose. They are only valid for the vendored release, which
+// the include of version.txt pins at compile time: 2021-03-27 reads as the
+// expression 1991.
+enum {
+	QuickJSVersion =
+#include "../../version.txt"
+};
+
+_Static_assert(QuickJSVersion == 2021 - 03 - 27, "the mirrored QuickJS internals must be checked against the vendored release");
+
+// JSClassID values of the built-in classes, from the JS_CLASS_* enum in
+// quickjs.c built with CONFIG_BIGNUM.
+enum {
+	ClassDate             = 10,
+	ClassRegExp           = 18,
+	ClassArrayBuffer      = 19,
+	ClassUint8CArray      = 21,
+	ClassInt8Array        = 22,
+	ClassUint8Array       = 23,
+	ClassInt16Array       = 24,
+	ClassUint16Array      = 25,
+	ClassInt32Array       = 26,
+	ClassUint32Array      = 27,
+	ClassBigInt64Array    = 28,
+	ClassBigUint64Array   = 29,
+	ClassFloat32Array     = 30,
+	ClassFloat64Array     = 31,
+	ClassMap              = 38,
+	ClassSet              = 39,
+	ClassProxy            = 48,
+	ClassPromise          = 49,
+};
+
+// ObjectHeader mirrors the start of JSObject, which holds the class id.
+typedef struct {
+	int ref_count;
+	uint8_t mark;
+	uint8_t flags;
+	uint16_t class_id;
+} ObjectHeader;
+
+static JSClassID ObjectClassID(JSValueConst v) {
+	if (!JS_IsObject(v))
+		return 0;
+	return ((ObjectHeader *)JS_VALUE_GET_PTR(v))->class_id;
+}
+
+// PromiseData mirrors JSPromiseData, the opaque data of promises.
+typedef struct {
+	int promise_state;
+	struct { void *prev, *next; } promise_reactions[2];
+	int is_handled;
+	JSValue promise_result;
+} PromiseData;
+
+static int GetPromiseState(JSValueConst v) {
+	PromiseData *s = JS_GetOpaque(v, ClassPromise);
+	return s ? s->promise_state : -1;
+}
+
+static JSValue GetPromiseResult(JSContext *ctx, JSValueConst v) {
+	PromiseData *s = JS_GetOpaque(v, ClassPromise);
+	return s ? JS_DupValue(ctx, s->promise_result) : JS_UNDEFINED;
+}
+
+// EngineState records the out of memory and stack overflow conditions QuickJS
+// runs into, which it only reports as InternalError exceptions scripts may
+// throw as well. Runtimes are created with an allocator noticing failed
+// allocations, and allocations made close to the stack limit, such as those
+// of the error thrown on stack overflow.
+typedef struct {
+	uintptr_t stack_limit;
+	int out_of_memory;
+	int stack_exhausted;
+} EngineState;
+
+// StackSlack is how close to the stack limit allocations count as made on
+// stack overflow, which leaves room for the frame that did not fit.
+#define StackSlack (64 * 1024)
+
+// CheckStack compares the stack pointer with the limit QuickJS derives from
+// the stack of the thread which created the runtime. Like the check of
+// QuickJS, it is only accurate on that thread, and best-effort elsewhere:
+// allocations are only counted within StackSlack on either side of the limit,
+// which stacks of other threads are unlikely to be.
+static void CheckStack(EngineState *e) {
+	uintptr_t sp = (uintptr_t)&e;
+	if (sp < e->stack_limit + StackSlack && sp + StackSlack > e->stack_limit)
+		e->stack_exhausted = 1;
+}
+
+// The allocator below is the default one of QuickJS, js_def_malloc and its
+// siblings, along with the tracking.
+#define MallocOverhead 8
+
+static size_t UsableSize(const void *ptr) {
+#if defined(__APPLE__)
+	return malloc_size(ptr);
+#elif defined(_WIN32)
+	return _msize((void *)ptr);
+#elif defined(EMSCRIPTEN)
+	return 0;
+#else
+	return malloc_usable_size((void *)ptr);
+#endif
+}
+
+static void *TrackedMalloc(JSMallocState *s, size_t size) {
+	EngineState *e = s->opaque;
+	void *ptr;
+
+	CheckStack(e);
+	if (s->malloc_size + size > s->malloc_limit) {
+		e->out_of_memory = 1;
+		return NULL;
+	}
+	ptr = malloc(size);
+	if (!ptr) {
+		e->out_of_memory = 1;
+		return NULL;
+	}
+	s->malloc_count++;
+	s->malloc_size += UsableSize(ptr) + MallocOverhead;
+	return ptr;
+}
+
+static void TrackedFree(JSMallocState *s, void *ptr) {
+	if (!ptr)
+		return;
+	s->malloc_count--;
+	s->malloc_size -= UsableSize(ptr) + MallocOverhead;
+	free(ptr);
+}
+
+static void *TrackedRealloc(JSMallocState *s, void *ptr, size_t size) {
+	EngineState *e = s->opaque;
+	size_t old_size;
+
+	if (!ptr) {
+		if (size == 0)
+			return NULL;
+		return TrackedMalloc(s, size);
+	}
+	old_size = UsableSize(ptr);
+	if (size == 0) {
+		s->malloc_count--;
+		s->malloc_size -= old_size + MallocOverhead;
+		free(ptr);
+		return NULL;
+	}
+
+	CheckStack(e);
+	if (s->malloc_size + size - old_size > s->malloc_limit) {
+		e->out_of_memory = 1;
+		return NULL;
+	}
+	ptr = realloc(ptr, size);
+	if (!ptr) {
+		e->out_of_memory = 1;
+		return NULL;
+	}
+	s->malloc_size += UsableSize(ptr) - old_size;
+	return ptr;
+}
+
+static const JSMallocFunctions TrackedMallocFunctions = {
+	TrackedMalloc,
+	TrackedFree,
+	TrackedRealloc,
+	UsableSize,
+};
+
+// NewTrackedRuntime creates a runtime with the tracking allocator, whose
+// state is returned in *state. QuickJS measures the top of the stack in
+// JS_NewRuntime2 as well, a few frames further down.
+static JSRuntime *NewTrackedRuntime(EngineState **state) {
+	JSRuntime *rt;
+	EngineState *e = calloc(1, sizeof(EngineState));
+	if (!e)
+		return NULL;
+
+	e->stack_limit = (uintptr_t)&e - JS_DEFAULT_STACK_SIZE;
+	rt = JS_NewRuntime2(&TrackedMallocFunctions, e);
+	if (!rt) {
+		free(e);
+		return NULL;
+	}
+	*state = e;
+	return rt;
+}
+
+// ThreadState, OSTimer and OSRWHandler mirror the runtime opaque data of
+// quickjs-libc and its timers and fd handlers, which only the static
+// js_os_poll runs.
+typedef struct ListHead {
+	struct ListHead *prev, *next;
+} ListHead;
+
+typedef struct {
+	ListHead os_rw_handlers;
+	ListHead os_signal_handlers;
+	ListHead os_timers;
+	ListHead port_list;
+} ThreadState;
+
+typedef struct {
+	ListHead link;
+	int has_object;
+	int64_t timeout;
+	JSValue func;
+} OSTimer;
+
+typedef struct {
+	ListHead link;
+	int fd;
+	JSValue rw_func[2];
+} OSRWHandler;
+
+// MonotonicMs matches get_time_ms, the clock of the os timers, which only
+// uses the monotonic clock on Linux and Apple systems.
+#if defined(__linux__) || defined(__APPLE__)
+static int64_t MonotonicMs(void) {
+	struct timespec ts;
+	clock_gettime(CLOCK_MONOTONIC, &ts);
+	return (uint64_t)ts.tv_sec * 1000 + (ts.tv_nsec / 1000000);
+}
+#else
+static int64_t MonotonicMs(void) {
+	struct timeval tv;
+	gettimeofday(&tv, NULL);
+	return (int64_t)tv.tv_sec * 1000 + (tv.tv_usec / 1000);
+}
+#endif
+
+// TakeDueTimer unlinks the first due timer like js_os_poll, and returns its
+// function. Otherwise it returns JS_UNDEFINED, with the milliseconds until the
+// next timer is due in *delay, or -1 if none is armed.
+static JSValue TakeDueTimer(JSRuntime *rt, ThreadState *ts, int64_t *delay) {
+	int64_t now = MonotonicMs();
+	ListHead *el;
+
+	*delay = -1;
+	for (el = ts->os_timers.next; el != &ts->os_timers; el = el->next) {
+		OSTimer *th = (OSTimer *)el;
+		int64_t d = th->timeout - now;
+		if (d <= 0) {
+			JSValue func = th->func;
+			th->func = JS_UNDEFINED;
+			el->prev->next = el->next;
+			el->next->prev = el->prev;
+			el->prev = el->next = NULL;
+			// timers with an object are freed by its finalizer
+			if (!th->has_object)
+				js_free_rt(rt, th);
+			return func;
+		}
+		if (*delay < 0 || d < *delay)
+			*delay = d;
+	}
+	return JS_UNDEFINED;
+}
+
+// TakeReadyHandler returns a duplicate of the function of an fd handler which
+// is ready, without waiting, or JS_UNDEFINED. *armed reports whether any fd
+// handler is installed.
+static JSValue TakeReadyHandler(JSContext *ctx, ThreadState *ts, int *armed) {
+	*armed = 0;
+#ifndef _WIN32
+	fd_set fds[2];
+	struct timeval tv = { 0, 0 };
+	ListHead *el;
+	int i, fd_max = -1;
+
+	FD_ZERO(&fds[0]);
+	FD_ZERO(&fds[1]);
+	for (el = ts->os_rw_handlers.next; el != &ts->os_rw_handlers; el = el->next) {
+		OSRWHandler *rh = (OSRWHandler *)el;
+		for (i = 0; i < 2; i++) {
+			if (!JS_IsNull(rh->rw_func[i])) {
+				FD_SET(rh->fd, &fds[i]);
+				if (rh->fd > fd_max)
+					fd_max = rh->fd;
+			}
+		}
+	}
+	if (fd_max < 0)
+		return JS_UNDEFINED;
+
+	*armed = 1;
+	if (select(fd_max + 1, &fds[0], &fds[1], NULL, &tv) <= 0)
+		return JS_UNDEFINED;
+
+	for (el = ts->os_rw_handlers.next; el != &ts->os_rw_handlers; el = el->next) {
+		OSRWHandler *rh = (OSRWHandler *)el;
+		for (i = 0; i < 2; i++) {
+			if (!JS_IsNull(rh->rw_func[i]) && FD_ISSET(rh->fd, &fds[i]))
+				return JS_DupValue(ctx, rh->rw_func[i]);
+		}
+	}
+#endif
+	return JS_UNDEFINED;
+}
+
+// PollOS takes the function of a due timer or a ready fd handler of the os
+// module, returning 1. Otherwise it returns 0, with the milliseconds until
+// the next timer is due in *delay, or -1, and whether fd handlers are
+// installed in *armed.
+static int PollOS(JSContext *ctx, JSValue *func, int64_t *delay, int *armed) {
+	JSRuntime *rt = JS_GetRuntime(ctx);
+	ThreadState *ts = JS_GetRuntimeOpaque(rt);
+
+	*delay = -1;
+	*armed = 0;
+	if (!ts)
+		return 0;
+
+	*func = TakeDueTimer(rt, ts, delay);
+	if (JS_IsUndefined(*func))
+		*func = TakeReadyHandler(ctx, ts, armed);
+	return !JS_IsUndefined(*func);
+}
+*/
+import "C"
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	classProxy   = C.JSClassID(C.ClassProxy)
+	classPromise = C.JSClassID(C.ClassPromise)
+)
+
+// builtinClasses maps the class ids of the built-in classes to their kind.
+var builtinClasses = map[C.JSClassID]ValueType{
+	C.ClassDate:           TypeDate,
+	C.ClassRegExp:         TypeRegExp,
+	C.ClassArrayBuffer:    TypeArrayBuffer,
+	C.ClassUint8CArray:    TypeTypedArray,
+	C.ClassInt8Array:      TypeTypedArray,
+	C.ClassUint8Array:     TypeTypedArray,
+	C.ClassInt16Array:     TypeTypedArray,
+	C.ClassUint16Array:    TypeTypedArray,
+	C.ClassInt32Array:     TypeTypedArray,
+	C.ClassUint32Array:    TypeTypedArray,
+	C.ClassBigInt64Array:  TypeTypedArray,
+	C.ClassBigUint64Array: TypeTypedArray,
+	C.ClassFloat32Array:   TypeTypedArray,
+	C.ClassFloat64Array:   TypeTypedArray,
+	C.ClassMap:            TypeMap,
+	C.ClassSet:            TypeSet,
+	C.ClassProxy:          TypeProxy,
+	C.ClassPromise:        TypePromise,
+}
+
+func (v Value) classID() C.JSClassID {
+	return C.ObjectClassID(v.ref)
+}
+
+// promiseState reads the state of a promise, or returns -1 for other values.
+func (v Value) promiseState() PromiseState {
+	return PromiseState(C.GetPromiseState(v.ref))
+}
+
+// promiseResult returns the settled value of a promise, which must be freed.
+func (v Value) promiseResult() Value {
+	return Value{ctx: v.ctx, ref: C.GetPromiseResult(v.ctx.ref, v.ref)}
+}
+
+// engines maps runtimes to the state their allocator records.
+var engines struct {
+	sync.Mutex
+	m map[*C.JSRuntime]*C.EngineState
+}
+
+// newRuntime creates a runtime recording the conditions internalError
+// checks. Like QuickJS, it measures the stack of the calling thread, so the
+// runtime must be used on the thread which created it.
+func newRuntime() *C.JSRuntime {
+	var e *C.EngineState
+	rt := C.NewTrackedRuntime(&e)
+	if rt == nil {
+		return nil
+	}
+
+	engines.Lock()
+	defer engines.Unlock()
+
+	if engines.m == nil {
+		engines.m = make(map[*C.JSRuntime]*C.EngineState)
+	}
+	engines.m[rt] = e
+	return rt
+}
+
+func engineOf(rt *C.JSRuntime) *C.EngineState {
+	engines.Lock()
+	defer engines.Unlock()
+	return engines.m[rt]
+}
+
+// freeRuntime frees rt along with its engine state, which the allocator uses
+// until the runtime is gone.
+func freeRuntime(rt *C.JSRuntime) {
+	engines.Lock()
+	e := engines.m[rt]
+	delete(engines.m, rt)
+	engines.Unlock()
+
+	C.JS_FreeRuntime(rt)
+	C.free(unsafe.Pointer(e))
+}
+
+// resetConditions clears the conditions recorded for the runtime, so that
+// only those of the call which starts next are reported.
+func (r Runtime) resetConditions() {
+	if e := engineOf(r.ref); e != nil {
+		e.out_of_memory = 0
+		e.stack_exhausted = 0
+	}
+	loopOf(r.ref).interrupted = false
+}
+
+// engineConditions are the conditions of a runtime internalError matches.
+type engineConditions struct {
+	outOfMemory, stackExhausted, interrupted bool
+}
+
+// conditions returns the conditions the runtime ran into since the current
+// call started. They must only be used for the exception of that call.
+func (r Runtime) conditions() engineConditions {
+	var c engineConditions
+	if e := engineOf(r.ref); e != nil {
+		c.outOfMemory, c.stackExhausted = e.out_of_memory != 0, e.stack_exhausted != 0
+	}
+	c.interrupted = loopOf(r.ref).interrupted
+	return c
+}
+
+// internalError returns ErrOutOfMemory, ErrStackOverflow or ErrInterrupted if
+// the runtime ran into the condition an InternalError with cause reports.
+func (c engineConditions) internalError(cause string) error {
+	switch {
+	case cause == "InternalError: out of memory" && c.outOfMemory:
+		return ErrOutOfMemory
+	case cause == "InternalError: stack overflow" && c.stackExhausted:
+		return ErrStackOverflow
+	case cause == "InternalError: interrupted" && c.interrupted:
+		return ErrInterrupted
+	}
+	return nil
+}
+
+// osPollInterval is how often the event loop checks the fd handlers of the os
+// module while it waits.
+const osPollInterval = 10 * time.Millisecond
+
+// pollOS takes the function of a timer or fd handler of the os module which
+// is ready to run. Otherwise it returns how long the loop may wait before
+// polling again, or a negative duration if nothing is armed.
+func (ctx *Context) pollOS() (fn Value, ok bool, next time.Duration) {
+	var (
+		ref   C.JSValue
+		delay C.int64_t
+		armed C.int
+	)
+	if C.PollOS(ctx.ref, &ref, &delay, &armed) != 0 {
+		return Value{ctx: ctx, ref: ref}, true, 0
+	}
+
+	next = time.Duration(delay) * time.Millisecond
+	if armed != 0 && (next < 0 || next > osPollInterval) {
+		next = osPollInterval
+	}
+	return Value{}, false, next
+}
@@ -0,0 +1,55 @@
+package quickjs
+
+/*
+#include "quickjs.h"
+
+extern int interruptHandler(JSRuntime *rt, void *opaque);
+
+static void SetInterruptHandler(JSRuntime *rt, int enabled) {
+	JS_SetInterruptHandler(rt, enabled ? interruptHandler : NULL, NULL);
+}
+*/
+import "C"
+
+import "unsafe"
+
+// SetInterruptHandler registers fn to be polled regularly while scripts run.
+// When fn returns true, the running script is stopped with an exception
+// matching ErrInterrupted, which scripts can not catch. A panic in fn
+// interrupts the script as well. A nil fn removes the handler.
+func (r Runtime) SetInterruptHandler(fn func() bool) {
+	loopOf(r.ref).interrupt = fn
+	if fn != nil {
+		C.SetInterruptHandler(r.ref, 1)
+	} else {
+		C.SetInterruptHandler(r.ref, 0)
+	}
+}
+
+// ResetUncatchableError lets scripts catch the pending exception again after
+// an interrupt made it uncatchable. Eval, Call and the other methods returning
+// errors take the exception, so a context can be reused after they returned
+// ErrInterrupted without it, as long as the interrupt handler stops
+// returning true.
+func (ctx *Context) ResetUncatchableError() {
+	C.JS_ResetUncatchableError(ctx.ref)
+}
+
+//export interruptHandler
+func interruptHandler(rt *C.JSRuntime, opaque unsafe.Pointer) (interrupt C.int) {
+	loop := loopOf(rt)
+	fn := loop.interrupt
+	if fn == nil {
+		return 0
+	}
+
+	defer catchPanic(func(r interface{}) {
+		loop.interrupted = true
+		interrupt = 1
+	})
+	if fn() {
+		loop.interrupted = true
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package quickjs
+
+import "strings"
+
+// intrinsicPaths lists the built-in values captured when a context is created,
+// before scripts get a chance to replace the globals they are reachable from.
+var intrinsicPaths = []string{
+	"Symbol",
+	"Symbol.iterator",
+	"Symbol.asyncIterator",
+	"Symbol.toPrimitive",
+	"Symbol.toStringTag",
+	"Object.prototype",
+	"Object.is",
+	"Object.freeze",
+	"Object.seal",
+	"BigInt",
+	"BigFloat",
+	"BigFloat.parseFloat",
+	"BigFloat.prototype.toString",
+	"BigFloatEnv",
+	"BigDecimal",
+	"Array.prototype",
+	"Proxy",
+	"Reflect",
+	"WeakMap",
+	"WeakMap.prototype.get",
+	"WeakMap.prototype.set",
+	"InternalError",
+	"SyntaxError.prototype",
+	"TypeError.prototype",
+	"ReferenceError.prototype",
+	"RangeError.prototype",
+	"InternalError.prototype",
+	"AggregateError.prototype",
+}
+
+func (ctx *Context) captureIntrinsics() {
+	ctx.intrinsics = make(map[string]Value, len(intrinsicPaths))
+	for _, path := range intrinsicPaths {
+		ctx.intrinsics[path] = ctx.lookupGlobal(path)
+	}
+}
+
+// lookupGlobal follows a dotted path from the global object.
+func (ctx *Context) lookupGlobal(path string) Value {
+	v := ctx.DupValue(ctx.Globals())
+	for _, name := range strings.Split(path, ".") {
+		next := v.Get(name)
+		v.Free()
+		v = next
+	}
+	return v
+}
+
+// intrinsic returns a built-in value listed in intrinsicPaths. The result must
+// be freed. Contexts not created by NewContext have not captured their
+// intrinsics, and look them up from the global object instead.
+func (ctx *Context) intrinsic(path string) Value {
+	if v, ok := ctx.intrinsics[path]; ok {
+		return ctx.DupValue(v)
+	}
+	return ctx.lookupGlobal(path)
+}
+
+func (ctx *Context) freeIntrinsics() {
+	for _, v := range ctx.intrinsics {
+		v.Free()
+	}
+	ctx.intrinsics = nil
+}
@@ -0,0 +1,185 @@
+package quickjs
+
+/*
+#include "quickjs.h"
+*/
+import "C"
+
+import (
+	"errors"
+)
+
+// Iterate walks v using the JavaScript iterator protocol. fn is called with
+// every produced value, which is only valid for the duration of the call;
+// returning false or an error stops the iteration and closes the iterator.
+func (v Value) Iterate(fn func(v Value) (bool, error)) error {
+	iterator, err := v.iterator()
+	if err != nil {
+		return err
+	}
+	defer iterator.Free()
+
+	next := iterator.Get("next")
+	defer next.Free()
+
+	if next.IsException() {
+		return v.ctx.Exception()
+	}
+	if !next.IsFunction() {
+		return errors.New("iterator.next is not a function")
+	}
+
+	for {
+		result := Value{ctx: v.ctx, ref: C.JS_Call(v.ctx.ref, next.ref, iterator.ref, 0, nil)}
+		if result.IsException() {
+			return v.ctx.Exception()
+		}
+		if !result.IsObject() {
+			result.Free()
+			return errors.New("iterator result is not an object")
+		}
+
+		// as in the spec, the iterator is not closed when reading the result
+		// fails
+		done := result.Get("done")
+		if done.IsException() {
+			result.Free()
+			return v.ctx.Exception()
+		}
+		if done.Bool() {
+			done.Free()
+			result.Free()
+			return nil
+		}
+		done.Free()
+
+		value := result.Get("value")
+		result.Free()
+
+		if value.IsException() {
+			return v.ctx.Exception()
+		}
+
+		more, err := fn(value)
+		value.Free()
+
+		if err != nil || !more {
+			if closeErr := iterator.closeIterator(); err == nil {
+				err = closeErr
+			}
+			return err
+		}
+	}
+}
+
+type MapEntry struct {
+	Key   Value
+	Value Value
+}
+
+func (e MapEntry) Free() {
+	e.Key.Free()
+	e.Value.Free()
+}
+
+// MapEntries collects the [key, value] pairs produced by iterating v, such as
+// a Map. The returned keys and values must be freed by the caller.
+func (v Value) MapEntries() ([]MapEntry, error) {
+	var entries []MapEntry
+
+	err := v.Iterate(func(entry Value) (bool, error) {
+		if !entry.IsObject() {
+			return false, errors.New("map entry is not an object")
+		}
+		key := entry.GetByUint32(0)
+		if key.IsException() {
+			return false, v.ctx.Exception()
+		}
+		value := entry.GetByUint32(1)
+		if value.IsException() {
+			key.Free()
+			return false, v.ctx.Exception()
+		}
+		entries = append(entries, MapEntry{Key: key, Value: value})
+		return true, nil
+	})
+	if err != nil {
+		for _, entry := range entries {
+			entry.Free()
+		}
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// SetValues collects the values produced by iterating v, such as a Set. The
+// returned values must be freed by the caller.
+func (v Value) SetValues() ([]Value, error) {
+	var values []Value
+
+	err := v.Iterate(func(value Value) (bool, error) {
+		values = append(values, v.ctx.DupValue(value))
+		return true, nil
+	})
+	if err != nil {
+		for _, value := range values {
+			value.Free()
+		}
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (v Value) iterator() (Value, error) {
+	key := v.ctx.SymbolIterator()
+	defer key.Free()
+
+	atom := key.Atom()
+	defer atom.Free()
+
+	method := v.GetByAtom(atom)
+	defer method.Free()
+
+	if method.IsException() {
+		return method, v.ctx.Exception()
+	}
+	if !method.IsFunction() {
+		return v.ctx.Undefined(), errors.New("value is not iterable")
+	}
+
+	iterator := Value{ctx: v.ctx, ref: C.JS_Call(v.ctx.ref, method.ref, v.ref, 0, nil)}
+	if iterator.IsException() {
+		return iterator, v.ctx.Exception()
+	}
+	if !iterator.IsObject() {
+		iterator.Free()
+		return v.ctx.Undefined(), errors.New("iterator is not an object")
+	}
+
+	return iterator, nil
+}
+
+func (v Value) closeIterator() error {
+	method := v.Get("return")
+	defer method.Free()
+
+	if method.IsException() {
+		return v.ctx.Exception()
+	}
+	if method.IsUndefined() || method.IsNull() {
+		return nil
+	}
+	if !method.IsFunction() {
+		return errors.New("iterator.return is not a function")
+	}
+
+	result := Value{ctx: v.ctx, ref: C.JS_Call(v.ctx.ref, method.ref, v.ref, 0, nil)}
+	defer result.Free()
+
+	if result.IsException() {
+		return v.ctx.Exception()
+	}
+	return nil
+}
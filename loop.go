@@ -0,0 +1,572 @@
+package quickjs
+
+/*
+#include <stdint.h>
+#ifdef _WIN32
+#include <windows.h>
+#else
+#include <pthread.h>
+#endif
+#include "quickjs.h"
+
+static uintptr_t CurrentThread(void) {
+#ifdef _WIN32
+	return (uintptr_t)GetCurrentThreadId();
+#else
+	return (uintptr_t)pthread_self();
+#endif
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// eventLoop queues work for the owner thread of a runtime. Goroutines never
+// touch JavaScript values; they post tasks which the loop runs on the owner
+// thread instead.
+type eventLoop struct {
+	sync.Mutex
+	tasks []func() error
+
+	// thread is the OS thread running the loop or a Go function called by a
+	// script, and depth the number of them active on it.
+	thread uintptr
+	depth  int
+
+	// contexts lists the contexts created by NewContext in the runtime, in
+	// creation order. The callbacks of the os module run in the first one.
+	contexts []*Context
+
+	// pending counts the asynchronous operations which will post a task
+	// once they complete, and timers the armed timers.
+	pending int
+	timers  int
+
+	wake chan struct{}
+
+	// owner thread only
+	onRejection      rejectionHook
+	strictRejections bool
+	rejections       []rejection
+	failure          error
+	interrupt        func() bool
+	interrupted      bool
+}
+
+var loops struct {
+	sync.Mutex
+	m map[*C.JSRuntime]*eventLoop
+}
+
+// loopOf returns the event loop of a runtime, creating it on first use.
+func loopOf(rt *C.JSRuntime) *eventLoop {
+	loops.Lock()
+	defer loops.Unlock()
+
+	if loops.m == nil {
+		loops.m = make(map[*C.JSRuntime]*eventLoop)
+	}
+	loop, ok := loops.m[rt]
+	if !ok {
+		loop = &eventLoop{wake: make(chan struct{}, 1)}
+		loops.m[rt] = loop
+	}
+	return loop
+}
+
+func releaseLoop(rt *C.JSRuntime) {
+	loops.Lock()
+	defer loops.Unlock()
+
+	if loop, ok := loops.m[rt]; ok {
+		loop.freeRejections()
+		delete(loops.m, rt)
+	}
+}
+
+// contexts maps the contexts created by NewContext back to their *Context,
+// for callbacks which only receive the C pointer.
+var contexts struct {
+	sync.RWMutex
+	m map[*C.JSContext]*Context
+}
+
+func registerContext(ctx *Context) {
+	contexts.Lock()
+	defer contexts.Unlock()
+
+	if contexts.m == nil {
+		contexts.m = make(map[*C.JSContext]*Context)
+	}
+	contexts.m[ctx.ref] = ctx
+}
+
+func unregisterContext(ctx *Context) {
+	contexts.Lock()
+	delete(contexts.m, ctx.ref)
+	contexts.Unlock()
+}
+
+// contextOf returns the *Context owning ref, falling back to a bare Context
+// for contexts not created by NewContext.
+func contextOf(ref *C.JSContext) *Context {
+	contexts.RLock()
+	ctx, ok := contexts.m[ref]
+	contexts.RUnlock()
+
+	if !ok {
+		ctx = &Context{ref: ref}
+	}
+	return ctx
+}
+
+func (l *eventLoop) addContext(ctx *Context) {
+	l.Lock()
+	l.contexts = append(l.contexts, ctx)
+	l.Unlock()
+}
+
+func (l *eventLoop) removeContext(ctx *Context) {
+	l.Lock()
+	defer l.Unlock()
+
+	for i, c := range l.contexts {
+		if c == ctx {
+			l.contexts = append(l.contexts[:i], l.contexts[i+1:]...)
+			return
+		}
+	}
+}
+
+// firstContext returns the oldest context of the runtime still alive, if
+// there is one.
+func (l *eventLoop) firstContext() (*Context, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.contexts) == 0 {
+		return nil, false
+	}
+	return l.contexts[0], true
+}
+
+// events returns the event loop of the context's runtime.
+func (ctx *Context) events() *eventLoop {
+	if ctx.loop == nil {
+		ctx.loop = loopOf(C.JS_GetRuntime(ctx.ref))
+	}
+	return ctx.loop
+}
+
+// done returns a context.Context cancelled when the context is freed.
+func (ctx *Context) done() context.Context {
+	if ctx.cancel == nil {
+		ctx.doneCtx, ctx.cancel = context.WithCancel(context.Background())
+	}
+	return ctx.doneCtx
+}
+
+// enter records the calling goroutine as the owner thread of the loop until
+// the matching leave, locking it to its OS thread meanwhile so that no other
+// goroutine is seen running on that thread.
+func (l *eventLoop) enter() {
+	runtime.LockOSThread()
+	thread := uintptr(C.CurrentThread())
+
+	l.Lock()
+	l.thread = thread
+	l.depth++
+	l.Unlock()
+}
+
+func (l *eventLoop) leave() {
+	l.Lock()
+	if l.depth--; l.depth == 0 {
+		l.thread = 0
+	}
+	l.Unlock()
+
+	runtime.UnlockOSThread()
+}
+
+// isOwner reports whether the caller runs on the owner thread, inside the
+// loop or a Go function called by a script.
+func (l *eventLoop) isOwner() bool {
+	thread := uintptr(C.CurrentThread())
+
+	l.Lock()
+	defer l.Unlock()
+	return l.depth > 0 && l.thread == thread
+}
+
+func (l *eventLoop) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// begin registers an asynchronous operation, which must end by calling
+// complete.
+func (l *eventLoop) begin() {
+	l.Lock()
+	l.pending++
+	l.Unlock()
+}
+
+// complete ends an asynchronous operation, queueing task for the owner
+// thread.
+func (l *eventLoop) complete(task func() error) {
+	l.Lock()
+	l.pending--
+	l.tasks = append(l.tasks, task)
+	l.Unlock()
+
+	l.notify()
+}
+
+// post queues task for the owner thread.
+func (l *eventLoop) post(task func() error) {
+	l.Lock()
+	l.tasks = append(l.tasks, task)
+	l.Unlock()
+
+	l.notify()
+}
+
+func (l *eventLoop) addTimer() {
+	l.Lock()
+	l.timers++
+	l.Unlock()
+}
+
+// fireTimer disarms a timer, queueing task for the owner thread.
+func (l *eventLoop) fireTimer(task func() error) {
+	l.Lock()
+	l.timers--
+	l.tasks = append(l.tasks, task)
+	l.Unlock()
+
+	l.notify()
+}
+
+func (l *eventLoop) removeTimer() {
+	l.Lock()
+	l.timers--
+	l.Unlock()
+
+	l.notify()
+}
+
+// take returns the queued tasks, and whether the loop has to wait for more.
+func (l *eventLoop) take(waitTimers bool) ([]func() error, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	tasks := l.tasks
+	l.tasks = nil
+	return tasks, l.pending > 0 || (waitTimers && l.timers > 0)
+}
+
+// requeue puts back tasks which were taken but not run.
+func (l *eventLoop) requeue(tasks []func() error) {
+	l.Lock()
+	l.tasks = append(tasks, l.tasks...)
+	l.Unlock()
+}
+
+// step runs pending jobs, a due timer or ready fd handler of the os module,
+// or the queued tasks once. If there is nothing to run, it waits for an
+// outstanding asynchronous operation to post a task, or with waitTimers for
+// an armed timer. It reports that the loop is idle when there is nothing to
+// wait for.
+func (r Runtime) step(c context.Context, waitTimers bool) (idle bool, err error) {
+	if _, err := r.RunPendingJobs(0); err != nil {
+		return false, err
+	}
+
+	loop := loopOf(r.ref)
+	loop.enter()
+	defer loop.leave()
+
+	if err := loop.checkRejections(); err != nil {
+		return false, err
+	}
+
+	osNext := time.Duration(-1)
+	if ctx, ok := loop.firstContext(); ok {
+		fn, ok, next := ctx.pollOS()
+		if ok {
+			defer fn.Free()
+			ret, err := ctx.Call(ctx.Undefined(), fn, nil)
+			if err != nil {
+				return false, err
+			}
+			ret.Free()
+			return false, nil
+		}
+		osNext = next
+	}
+
+	tasks, wait := loop.take(waitTimers)
+	if len(tasks) == 0 {
+		waitOS := waitTimers && osNext >= 0
+		if !wait && !waitOS {
+			return !r.IsJobPending(), nil
+		}
+
+		var due <-chan time.Time
+		if waitOS {
+			timer := time.NewTimer(osNext)
+			defer timer.Stop()
+			due = timer.C
+		}
+
+		select {
+		case <-loop.wake:
+		case <-due:
+		case <-c.Done():
+			return false, c.Err()
+		}
+		return false, nil
+	}
+
+	for i, task := range tasks {
+		if err := task(); err != nil {
+			loop.requeue(tasks[i+1:])
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// RunLoop runs the event loop of the runtime on the calling thread: it
+// executes promise jobs, the tasks posted by asynchronous Go functions and
+// timers, and the timers and fd handlers of the os module. It returns nil
+// once there is nothing left to do, the error of c if c is cancelled first,
+// or the first exception left uncaught by a job, task or os callback. Signal
+// handlers and worker messages of the os module are not run.
+func (r Runtime) RunLoop(c context.Context) error {
+	return r.run(c, true)
+}
+
+func (r Runtime) run(c context.Context, waitTimers bool) error {
+	for {
+		if err := c.Err(); err != nil {
+			return err
+		}
+
+		idle, err := r.step(c, waitTimers)
+		if err != nil || idle {
+			return err
+		}
+	}
+}
+
+// RunUntilIdle runs the event loop of the context's runtime like RunLoop,
+// but returns instead of waiting for timers which are not due yet, and for the
+// fd handlers of the os module. With a ManualClock, advancing the clock and then calling
+// RunUntilIdle runs exactly the timers which became due.
+func (ctx *Context) RunUntilIdle() error {
+	return ctx.Runtime().run(context.Background(), false)
+}
+
+// Serve runs the event loop like RunLoop, but keeps waiting for tasks posted
+// with Post or Invoke when there is nothing left to do. It only returns once c
+// is cancelled or a job or task leaves an exception uncaught.
+func (r Runtime) Serve(c context.Context) error {
+	loop := loopOf(r.ref)
+	for {
+		if err := c.Err(); err != nil {
+			return err
+		}
+
+		idle, err := r.step(c, true)
+		if err != nil {
+			return err
+		}
+		if idle {
+			select {
+			case <-loop.wake:
+			case <-c.Done():
+				return c.Err()
+			}
+		}
+	}
+}
+
+// ErrContextFreed is returned by Invoke when the context is freed before the
+// function could run.
+var ErrContextFreed = errors.New("context has been freed")
+
+// Post queues fn to run on the owner thread of the context while its event
+// loop runs, waking the loop if it is waiting. It may be called from any
+// goroutine. fn is skipped if the context is freed first, and a panic in fn
+// stops the loop with a *PanicError.
+func (ctx *Context) Post(fn func(ctx *Context)) {
+	ctx.events().post(func() (err error) {
+		if ctx.freed() {
+			return nil
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+		fn(ctx)
+		return nil
+	})
+}
+
+// Invoke runs fn on the owner thread of the context like Post, and waits for
+// it to return. The error of fn, or a *PanicError if it panicked, is returned
+// to the caller instead of stopping the loop. Called on the owner thread
+// itself, from a Go function invoked by a script or a task run by the loop,
+// Invoke runs fn right away instead. Elsewhere it waits for the loop, even
+// on the goroutine which created the context.
+func (ctx *Context) Invoke(fn func(ctx *Context) error) error {
+	loop := ctx.events()
+	if loop.isOwner() {
+		// the loop cannot run fn while its own thread waits for it
+		return ctx.invoke(fn)
+	}
+
+	result := make(chan error, 1)
+	loop.post(func() error {
+		result <- ctx.invoke(fn)
+		return nil
+	})
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.done().Done():
+		// fn may have completed just before the context was freed
+		select {
+		case err := <-result:
+			return err
+		default:
+			return ErrContextFreed
+		}
+	}
+}
+
+// invoke runs fn for Invoke on the owner thread.
+func (ctx *Context) invoke(fn func(ctx *Context) error) (err error) {
+	if ctx.freed() {
+		return ErrContextFreed
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn(ctx)
+}
+
+// Runtime returns the runtime the context belongs to.
+func (ctx *Context) Runtime() Runtime {
+	return Runtime{ref: C.JS_GetRuntime(ctx.ref)}
+}
+
+// AsyncFunction creates a JavaScript function returning a promise, which is
+// settled with the outcome of fn. fn runs on its own goroutine with the
+// arguments converted to plain Go data, and must not use the context. The
+// promise is settled on the owner thread while the event loop runs, such as
+// in RunUntilIdle. The context.Context passed to fn is cancelled when the
+// context is freed. Functions and symbols among the arguments are borrowed
+// until the promise settles, and fn may return them unchanged.
+func (ctx *Context) AsyncFunction(fn func(ctx context.Context, args []interface{}) (interface{}, error)) Value {
+	return ctx.Function(func(ctx *Context, this Value, args []Value) Value {
+		var borrowed []Value
+		end := ctx.borrow(&borrowed)
+
+		in := make([]interface{}, len(args))
+		for i, arg := range args {
+			v, err := arg.export()
+			if err != nil {
+				end()
+				for _, v := range borrowed {
+					v.Free()
+				}
+				return ctx.ThrowTypeError("argument %d: %v", i+1, err)
+			}
+			in[i] = v
+		}
+		end()
+
+		// the borrowed values are released with the context if fn never
+		// completes
+		handles := make([]*retainedValue, len(borrowed))
+		for i, v := range borrowed {
+			handles[i] = ctx.retain(v)
+			v.Free()
+		}
+
+		promise, resolve, reject := ctx.NewPromise()
+		if promise.IsException() {
+			return promise
+		}
+
+		// the resolving functions are released with the context if fn
+		// never completes
+		resolveHandle, rejectHandle := ctx.retain(resolve), ctx.retain(reject)
+		resolve.Free()
+		reject.Free()
+
+		loop, done := ctx.events(), ctx.done()
+		loop.begin()
+
+		go func() {
+			var (
+				result interface{}
+				err    error
+			)
+			defer func() {
+				if r := recover(); r != nil {
+					err = &PanicError{Value: r, Stack: debug.Stack()}
+				}
+				loop.complete(func() error {
+					defer runtime.KeepAlive(handles)
+					return ctx.settle(resolveHandle, rejectHandle, result, err, borrowed)
+				})
+			}()
+			result, err = fn(done, in)
+		}()
+
+		return promise
+	})
+}
+
+// settle resolves or rejects a promise created by AsyncFunction, whose
+// arguments borrowed the given values.
+func (ctx *Context) settle(resolve, reject *retainedValue, result interface{}, err error, borrowed []Value) error {
+	if ctx.freed() {
+		return nil
+	}
+
+	fn, arg := resolve.Value(), ctx.Undefined()
+	if err == nil {
+		arg, err = ctx.toJS(ctx.handOver(reflect.ValueOf(result), borrowed))
+		if err != nil {
+			err = fmt.Errorf("result: %w", err)
+		}
+	}
+	if err != nil {
+		fn, arg = reject.Value(), ctx.Error(err)
+	}
+	defer arg.Free()
+
+	ret, err := ctx.Call(ctx.Undefined(), fn, []Value{arg})
+	ret.Free()
+	return err
+}
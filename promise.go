@@ -0,0 +1,231 @@
+package quickjs
+
+/*
+#include "quickjs.h"
+
+extern void promiseRejectionTracker(JSContext *ctx, JSValue promise, JSValue reason, int is_handled, void *opaque);
+
+static void SetPromiseRejectionTracker(JSRuntime *rt) {
+	JS_SetHostPromiseRejectionTracker(rt, promiseRejectionTracker, NULL);
+}
+
+static int SameObject(JSValueConst a, JSValueConst b) {
+	return JS_VALUE_GET_PTR(a) == JS_VALUE_GET_PTR(b);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"unsafe"
+)
+
+type PromiseState int
+
+const (
+	PromisePending PromiseState = iota
+	PromiseFulfilled
+	PromiseRejected
+)
+
+func (s PromiseState) String() string {
+	switch s {
+	case PromisePending:
+		return "pending"
+	case PromiseFulfilled:
+		return "fulfilled"
+	case PromiseRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+var (
+	ErrNotPromise     = errors.New("value is not a promise")
+	ErrPromisePending = errors.New("promise is pending")
+)
+
+// NewPromise creates a pending promise along with the functions resolving and
+// rejecting it. All three values must be freed.
+func (ctx *Context) NewPromise() (promise, resolve, reject Value) {
+	var funcs [2]C.JSValue
+
+	promise = Value{ctx: ctx, ref: C.JS_NewPromiseCapability(ctx.ref, &funcs[0])}
+	if promise.IsException() {
+		return promise, ctx.Undefined(), ctx.Undefined()
+	}
+	return promise, Value{ctx: ctx, ref: funcs[0]}, Value{ctx: ctx, ref: funcs[1]}
+}
+
+func (v Value) IsPromise() bool { return v.IsObject() && v.Type() == TypePromise }
+
+func (v Value) PromiseState() (PromiseState, error) {
+	if v.classID() != classPromise {
+		return PromisePending, ErrNotPromise
+	}
+	return v.promiseState(), nil
+}
+
+// PromiseResult returns the value a settled promise was fulfilled with, or
+// the reason it was rejected with.
+func (v Value) PromiseResult() (Value, error) {
+	if v.classID() != classPromise {
+		return v.ctx.Undefined(), ErrNotPromise
+	}
+	if v.promiseState() == PromisePending {
+		return v.ctx.Undefined(), ErrPromisePending
+	}
+	return v.promiseResult(), nil
+}
+
+// Await runs the event loop until the promise settles, returning the value
+// it was fulfilled with. A rejection is returned as an error. Values other
+// than promises are returned as they are, duplicated. Await fails with
+// ErrPromisePending if the loop runs out of work before the promise settles.
+func (v Value) Await(c context.Context) (Value, error) {
+	if !v.IsPromise() {
+		return v.ctx.DupValue(v), nil
+	}
+
+	for {
+		state, _ := v.PromiseState()
+		switch state {
+		case PromiseFulfilled:
+			return v.PromiseResult()
+		case PromiseRejected:
+			reason, _ := v.PromiseResult()
+			defer reason.Free()
+			return v.ctx.Undefined(), reason.rejection()
+		}
+
+		idle, err := v.ctx.Runtime().step(c, true)
+		if err != nil {
+			return v.ctx.Undefined(), err
+		}
+		if state, _ := v.PromiseState(); idle && state == PromisePending {
+			return v.ctx.Undefined(), ErrPromisePending
+		}
+	}
+}
+
+// rejection converts the reason of a rejected promise to an error.
+func (v Value) rejection() error {
+	if err := v.Error(); err != nil {
+		return err
+	}
+	return v.thrownValue()
+}
+
+// UnhandledRejectionError is returned by the event loop in strict mode when a
+// promise is rejected without a handler.
+type UnhandledRejectionError struct {
+	Err error
+}
+
+func (e *UnhandledRejectionError) Error() string {
+	return "unhandled promise rejection: " + e.Err.Error()
+}
+
+func (e *UnhandledRejectionError) Unwrap() error { return e.Err }
+
+type rejectionHook func(ctx *Context, promise, reason Value, handled bool)
+
+// rejection is a promise rejected without a handler, kept until a handler is
+// attached or the event loop reports it.
+type rejection struct {
+	rt      *C.JSRuntime
+	ctx     *Context
+	promise Value
+	reason  Value
+}
+
+// free releases the values through the runtime, since the context may have
+// been freed already.
+func (r rejection) free() {
+	C.JS_FreeValueRT(r.rt, r.promise.ref)
+	C.JS_FreeValueRT(r.rt, r.reason.ref)
+}
+
+// OnPromiseRejection registers fn to be called when a promise is rejected
+// without a handler, and again with handled set when a handler is attached
+// later on. The values passed to fn must not be freed.
+func (r Runtime) OnPromiseRejection(fn func(ctx *Context, promise, reason Value, handled bool)) {
+	loopOf(r.ref).onRejection = fn
+	C.SetPromiseRejectionTracker(r.ref)
+}
+
+// SetStrictPromiseRejections makes the event loop fail with an
+// UnhandledRejectionError when a promise is still rejected without a handler
+// after the pending jobs have run.
+func (r Runtime) SetStrictPromiseRejections(strict bool) {
+	loopOf(r.ref).strictRejections = strict
+	C.SetPromiseRejectionTracker(r.ref)
+}
+
+//export promiseRejectionTracker
+func promiseRejectionTracker(ref *C.JSContext, promise, reason C.JSValue, isHandled C.int, opaque unsafe.Pointer) {
+	ctx := contextOf(ref)
+	loop := loopOf(C.JS_GetRuntime(ref))
+	handled := isHandled != 0
+
+	if loop.strictRejections {
+		if handled {
+			loop.forgetRejection(promise)
+		} else {
+			loop.rejections = append(loop.rejections, rejection{
+				rt:      C.JS_GetRuntime(ref),
+				ctx:     ctx,
+				promise: Value{ctx: ctx, ref: C.JS_DupValue(ref, promise)},
+				reason:  Value{ctx: ctx, ref: C.JS_DupValue(ref, reason)},
+			})
+		}
+	}
+
+	if loop.onRejection != nil {
+		defer catchPanic(func(r interface{}) {
+			loop.failure = &PanicError{Value: r, Stack: debug.Stack()}
+		})
+		loop.onRejection(ctx, Value{ctx: ctx, ref: promise}, Value{ctx: ctx, ref: reason}, handled)
+	}
+}
+
+func (l *eventLoop) forgetRejection(promise C.JSValue) {
+	for i, r := range l.rejections {
+		if C.SameObject(r.promise.ref, promise) != 0 {
+			r.free()
+			l.rejections = append(l.rejections[:i], l.rejections[i+1:]...)
+			return
+		}
+	}
+}
+
+// checkRejections reports the first rejection left without a handler, and
+// failures of the rejection hook.
+func (l *eventLoop) checkRejections() error {
+	if err := l.failure; err != nil {
+		l.failure = nil
+		return err
+	}
+
+	for len(l.rejections) > 0 {
+		r := l.rejections[0]
+		l.rejections = l.rejections[1:]
+
+		if !r.ctx.freed() {
+			err := &UnhandledRejectionError{Err: r.reason.rejection()}
+			r.free()
+			return err
+		}
+		r.free()
+	}
+	return nil
+}
+
+func (l *eventLoop) freeRejections() {
+	for _, r := range l.rejections {
+		r.free()
+	}
+	l.rejections = nil
+}
@@ -1,10 +1,14 @@
 package quickjs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -28,7 +32,47 @@ import (
 #include "quickjs.h"
 #include "quickjs-libc.h"
 
-extern JSValue proxy(JSContext *ctx, JSValueConst this_val, int argc, JSValueConst *argv);
+extern JSValue proxy(JSContext *ctx, JSValueConst this_val, int argc, JSValueConst *argv, int magic, JSValue *func_data);
+extern void handleFinalizer(JSRuntime *rt, JSValue val);
+
+static int RegisterHandleClass(JSRuntime *rt, JSClassID class_id) {
+	JSClassDef def = { .class_name = "GoHandle", .finalizer = handleFinalizer };
+	return JS_NewClass(rt, class_id, &def);
+}
+
+// NewHandle creates an object holding a Go ObjectId in its opaque slot, out
+// of reach of scripts. The id is released when the object is collected.
+static JSValue NewHandle(JSContext *ctx, JSClassID class_id, int64_t id) {
+	JSValue handle = JS_NewObjectClass(ctx, class_id);
+	if (!JS_IsException(handle))
+		JS_SetOpaque(handle, (void *)(intptr_t)id);
+	return handle;
+}
+
+static int64_t HandleID(JSValueConst handle, JSClassID class_id) {
+	return (int64_t)(intptr_t)JS_GetOpaque(handle, class_id);
+}
+
+// NewFunc keeps the handle of the Go function as function data, so scripts
+// cannot reach or forge it.
+static JSValue NewFunc(JSContext *ctx, JSClassID class_id, int64_t id, const char *name, int length) {
+	JSValue handle, fn;
+
+	handle = NewHandle(ctx, class_id, id);
+	if (JS_IsException(handle))
+		return handle;
+
+	fn = JS_NewCFunctionData(ctx, proxy, length, 0, 1, &handle);
+	JS_FreeValue(ctx, handle);
+	if (JS_IsException(fn))
+		return fn;
+
+	if (JS_DefinePropertyValueStr(ctx, fn, "name", JS_NewString(ctx, name), JS_PROP_CONFIGURABLE) < 0) {
+		JS_FreeValue(ctx, fn);
+		return JS_EXCEPTION;
+	}
+	return fn;
+}
 
 static JSValue JS_NewNull() { return JS_NULL; }
 static JSValue JS_NewUndefined() { return JS_UNDEFINED; }
@@ -134,13 +178,6 @@ static JSContext *JS_NewCustomContext(JSRuntime *rt)
     return ctx;
 }
 
-static JSRuntime* NewJsRuntime() {
-	JSRuntime *rt = JS_NewRuntime();
-    js_std_init_handlers(rt);
-
-	return rt;
-}
-
 static JSContext* NewJsContext(JSRuntime *rt) {
 	js_std_set_worker_new_context_func(JS_NewCustomContext);
     js_std_init_handlers(rt);
@@ -151,7 +188,6 @@ static JSContext* NewJsContext(JSRuntime *rt) {
 
 	js_std_add_helpers(ctx, -1, NULL);
 	SetBaseGlobal(ctx);
-	js_std_loop(ctx);
 
 	return ctx;
 }
@@ -169,15 +205,26 @@ type Runtime struct {
 	ref *C.JSRuntime
 }
 
+var handleClassID C.JSClassID
+
+var handleClassOnce sync.Once
+
 func NewRuntime() Runtime {
-	rt := Runtime{ref: C.NewJsRuntime()}
+	handleClassOnce.Do(func() { C.JS_NewClassID(&handleClassID) })
+
+	rt := Runtime{ref: newRuntime()}
+	C.js_std_init_handlers(rt.ref)
 	C.JS_SetCanBlock(rt.ref, C.int(1))
+	C.RegisterHandleClass(rt.ref, handleClassID)
 	return rt
 }
 
 func (r Runtime) RunGC() { C.JS_RunGC(r.ref) }
 
-func (r Runtime) Free() { C.JS_FreeRuntime(r.ref) }
+func (r Runtime) Free() {
+	releaseLoop(r.ref)
+	freeRuntime(r.ref)
+}
 
 func (r Runtime) SetMemoryLimit(limit uint32) {
 	C.JS_SetMemoryLimit(r.ref, C.size_t(limit))
@@ -188,25 +235,63 @@ func (r Runtime) StdFreeHandlers() {
 }
 
 func (r Runtime) NewContext() *Context {
-	ref := C.NewJsContext(r.ref)
-
-	return &Context{ref: ref}
+	ctx := &Context{ref: C.NewJsContext(r.ref)}
+	// set up before other goroutines can Post to the context
+	ctx.done()
+	ctx.captureIntrinsics()
+	registerContext(ctx)
+	ctx.events().addContext(ctx)
+	return ctx
+}
+
+// ExecutePendingJob runs one pending job, returning the context it ran in.
+// It returns io.EOF if no job was pending. See RunPendingJobs.
+func (r Runtime) ExecutePendingJob() (*Context, error) {
+	var ref *C.JSContext
+
+	r.resetConditions()
+	switch C.JS_ExecutePendingJob(r.ref, &ref) {
+	case 0:
+		return nil, io.EOF
+	case -1:
+		ctx := contextOf(ref)
+		return ctx, &JobError{Context: ctx, Err: ctx.Exception()}
+	}
+	return contextOf(ref), nil
 }
 
-func (r Runtime) ExecutePendingJob() (Context, error) {
-	var ctx Context
+// IsJobPending reports whether promise jobs are waiting to be run.
+func (r Runtime) IsJobPending() bool { return C.JS_IsJobPending(r.ref) != 0 }
 
-	err := C.JS_ExecutePendingJob(r.ref, &ctx.ref)
-	if err <= 0 {
-		if err == 0 {
-			return ctx, io.EOF
+// RunPendingJobs runs up to limit pending jobs, or all of them, including
+// jobs queued meanwhile, if limit is not positive. It returns the number of
+// jobs run, stopping at the first job which throws.
+func (r Runtime) RunPendingJobs(limit int) (int, error) {
+	n := 0
+	for limit <= 0 || n < limit {
+		_, err := r.ExecutePendingJob()
+		if err == io.EOF {
+			break
+		}
+		n++
+		if err != nil {
+			return n, err
 		}
-		return ctx, ctx.Exception()
 	}
+	return n, nil
+}
 
-	return ctx, nil
+// JobError is the exception thrown by a pending job, along with the context
+// the job ran in.
+type JobError struct {
+	Context *Context
+	Err     error
 }
 
+func (e *JobError) Error() string { return e.Err.Error() }
+
+func (e *JobError) Unwrap() error { return e.Err }
+
 type Function func(ctx *Context, this Value, args []Value) Value
 
 type funcEntry struct {
@@ -229,62 +314,141 @@ func restoreFuncPtr(id ObjectId) *funcEntry {
 }
 
 //export proxy
-func proxy(ctx *C.JSContext, thisVal C.JSValueConst, argc C.int, argv *C.JSValueConst) C.JSValue {
+func proxy(ctx *C.JSContext, thisVal C.JSValueConst, argc C.int, argv *C.JSValueConst, magic C.int, funcData *C.JSValue) (result C.JSValue) {
 	refs := (*[1 << unsafe.Sizeof(0)]C.JSValueConst)(unsafe.Pointer(argv))[:argc:argc]
 
-	id := C.int64_t(0)
-	C.JS_ToInt64(ctx, &id, refs[0])
+	entry := restoreFuncPtr(ObjectId(C.HandleID(*funcData, handleClassID)))
+	if entry == nil {
+		causePtr := C.CString("go function has been released")
+		defer C.free(unsafe.Pointer(causePtr))
+		return C.ThrowInternalError(ctx, causePtr)
+	}
 
-	entry := restoreFuncPtr(ObjectId(id))
+	loop := entry.ctx.events()
+	loop.enter()
+	defer loop.leave()
 
-	args := make([]Value, len(refs)-1)
+	defer catchPanic(func(r interface{}) {
+		result = entry.ctx.throwPanic(r).ref
+	})
+
+	args := make([]Value, len(refs))
 	for i := 0; i < len(args); i++ {
 		args[i].ctx = entry.ctx
-		args[i].ref = refs[1+i]
+		args[i].ref = refs[i]
 	}
 
-	result := entry.fn(entry.ctx, Value{ctx: entry.ctx, ref: thisVal}, args)
+	return entry.fn(entry.ctx, Value{ctx: entry.ctx, ref: thisVal}, args).ref
+}
+
+//export handleFinalizer
+func handleFinalizer(rt *C.JSRuntime, val C.JSValue) {
+	id := ObjectId(C.HandleID(val, handleClassID))
+	id.Free()
+}
+
+// handle wraps obj into a JavaScript object that keeps it alive until the
+// object is garbage collected.
+func (ctx *Context) handle(obj interface{}) Value {
+	id := NewObjectId(obj)
 
-	return result.ref
+	val := Value{ctx: ctx, ref: C.NewHandle(ctx.ref, handleClassID, C.int64_t(id))}
+	if val.IsException() {
+		id.Free()
+	}
+	return val
+}
+
+func (v Value) handleObject() (interface{}, bool) {
+	return ObjectId(C.HandleID(v.ref, handleClassID)).Get()
 }
 
 type Context struct {
-	ref     *C.JSContext
-	globals *Value
-	proxy   *Value
+	ref          *C.JSContext
+	globals      *Value
+	helpers      map[string]Value
+	slots        *Value
+	intrinsics   map[string]Value
+	retained     *retainedValues
+	borrowed     *[]Value
+	exporting    []Value
+	stored       map[C.JSValue]int
+	classes      []*Class
+	constructors []int
+	loop         *eventLoop
+	timers       *timerSet
+	doneCtx      context.Context
+	cancel       context.CancelFunc
+	repanic      bool
 }
 
 func (ctx *Context) Free() {
-	if ctx.proxy != nil {
-		ctx.proxy.Free()
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+	unregisterContext(ctx)
+	ctx.events().removeContext(ctx)
+	if ctx.timers != nil {
+		ctx.timers.free()
+	}
+	ctx.freeRetainedValues()
+	for _, class := range ctx.classes {
+		class.free()
+	}
+	ctx.freeConstructors()
+	for _, helper := range ctx.helpers {
+		helper.Free()
 	}
+	if ctx.slots != nil {
+		ctx.slots.Free()
+	}
+	ctx.freeIntrinsics()
 	if ctx.globals != nil {
 		ctx.globals.Free()
 	}
 
 	C.JS_FreeContext(ctx.ref)
+	ctx.ref = nil
 }
 
+func (ctx *Context) freed() bool { return ctx.ref == nil }
+
 func (ctx *Context) Function(fn Function) Value {
-	val := ctx.eval(`(proxy, id) => function() { return proxy.call(this, id, ...arguments); }`)
+	return ctx.NamedFunction("", 0, fn)
+}
+
+// NamedFunction creates a JavaScript function calling fn, with the given name
+// and length properties.
+func (ctx *Context) NamedFunction(name string, length int, fn Function) Value {
+	namePtr := C.CString(name)
+	defer C.free(unsafe.Pointer(namePtr))
+
+	id := storeFuncPtr(&funcEntry{ctx: ctx, fn: fn})
+
+	val := Value{ctx: ctx, ref: C.NewFunc(ctx.ref, handleClassID, C.int64_t(id), namePtr, C.int(length))}
 	if val.IsException() {
-		return val
+		id.Free()
 	}
-	defer val.Free()
-
-	funcPtr := storeFuncPtr(&funcEntry{ctx: ctx, fn: fn})
-	funcPtrVal := ctx.Int64(int64(funcPtr))
+	return val
+}
 
-	if ctx.proxy == nil {
-		ctx.proxy = &Value{
-			ctx: ctx,
-			ref: C.JS_NewCFunction(ctx.ref, (*C.JSCFunction)(unsafe.Pointer(C.proxy)), nil, C.int(0)),
-		}
+// helper returns the function produced by evaluating code, compiling it only
+// once per context. Helpers must not be freed by the caller.
+func (ctx *Context) helper(name, code string) (Value, error) {
+	if fn, ok := ctx.helpers[name]; ok {
+		return fn, nil
 	}
 
-	args := []C.JSValue{ctx.proxy.ref, funcPtrVal.ref}
+	fn, err := ctx.Eval(code, EVAL_GLOBAL)
+	if err != nil {
+		return fn, err
+	}
 
-	return Value{ctx: ctx, ref: C.JS_Call(ctx.ref, val.ref, ctx.Null().ref, C.int(len(args)), &args[0])}
+	if ctx.helpers == nil {
+		ctx.helpers = make(map[string]Value)
+	}
+	ctx.helpers[name] = fn
+	return fn, nil
 }
 
 func (ctx *Context) DupValue(value Value) Value {
@@ -293,22 +457,25 @@ func (ctx *Context) DupValue(value Value) Value {
 
 func (ctx *Context) JsFunction(this Value, fn Value, args []Value) Value {
 	if fn.IsFunction() {
-		var _argsptr *C.JSValue = nil
-		if len(args) != 0 {
-			_args := make([]C.JSValue, len(args))
-			for i := 0; i < len(args); i++ {
-				_args[i] = args[i].ref
-			}
-
-			_argsptr = &_args[0]
-		}
-
-		return Value{ctx: ctx, ref: C.JS_Call(ctx.ref, fn.ref, this.ref, C.int(len(args)), _argsptr)}
+		argc, argv := valueRefs(args)
+		return Value{ctx: ctx, ref: C.JS_Call(ctx.ref, fn.ref, this.ref, argc, argv)}
 	} else {
 		return ctx.Error(errors.New("fn must be function"))
 	}
 }
 
+func valueRefs(args []Value) (C.int, *C.JSValue) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	refs := make([]C.JSValue, len(args))
+	for i := 0; i < len(args); i++ {
+		refs[i] = args[i].ref
+	}
+	return C.int(len(refs)), &refs[0]
+}
+
 func (ctx *Context) Null() Value {
 	return Value{ctx: ctx, ref: C.JS_NewNull()}
 }
@@ -321,9 +488,24 @@ func (ctx *Context) Uninitialized() Value {
 	return Value{ctx: ctx, ref: C.JS_NewUninitialized()}
 }
 
+// Error creates a JavaScript Error for err. The Error carries err, which is
+// restored when it is thrown back to Go: errors.Is and errors.As see through
+// the returned *Error to err. If an error in the chain of err has a
+// Code() string method, its result is set as the code property, and the error
+// err wraps becomes the cause property.
 func (ctx *Context) Error(err error) Value {
 	val := Value{ctx: ctx, ref: C.JS_NewError(ctx.ref)}
 	val.Set("message", ctx.String(err.Error()))
+
+	var coder interface{ Code() string }
+	if errors.As(err, &coder) {
+		val.Set("code", ctx.String(coder.Code()))
+	}
+	if cause := errors.Unwrap(err); cause != nil {
+		val.Set("cause", ctx.Error(cause))
+	}
+
+	ctx.attach(val, err)
 	return val
 }
 
@@ -347,7 +529,7 @@ func (ctx *Context) Uint32(v uint32) Value {
 	return Value{ctx: ctx, ref: C.JS_NewUint32(ctx.ref, C.uint32_t(v))}
 }
 
-func (ctx *Context) BigInt64(v uint64) Value {
+func (ctx *Context) BigInt64(v int64) Value {
 	return Value{ctx: ctx, ref: C.JS_NewBigInt64(ctx.ref, C.int64_t(v))}
 }
 
@@ -355,6 +537,104 @@ func (ctx *Context) BigUint64(v uint64) Value {
 	return Value{ctx: ctx, ref: C.JS_NewBigUint64(ctx.ref, C.uint64_t(v))}
 }
 
+// BigInt converts v to a BigInt value.
+func (ctx *Context) BigInt(v *big.Int) (Value, error) {
+	if v == nil {
+		return ctx.Undefined(), errors.New("nil big integer")
+	}
+
+	fn, err := ctx.helper("bigInt", `(BigInt, hex, negative) => negative ? -BigInt(hex) : BigInt(hex)`)
+	if err != nil {
+		return fn, err
+	}
+
+	ctor := ctx.intrinsic("BigInt")
+	defer ctor.Free()
+
+	hex, negative := ctx.String("0x"+new(big.Int).Abs(v).Text(16)), ctx.Bool(v.Sign() < 0)
+	defer hex.Free()
+
+	return ctx.Call(ctx.Undefined(), fn, []Value{ctor, hex, negative})
+}
+
+var bigFloatRoundingModes = map[big.RoundingMode]string{
+	big.ToNearestEven: "RNDN",
+	big.ToNearestAway: "RNDNA",
+	big.ToZero:        "RNDZ",
+	big.AwayFromZero:  "RNDA",
+	big.ToNegativeInf: "RNDD",
+	big.ToPositiveInf: "RNDU",
+}
+
+// BigFloat converts v exactly, parsing it with an environment using the
+// precision and rounding mode of v.
+func (ctx *Context) BigFloat(v *big.Float) (Value, error) {
+	if v == nil {
+		return ctx.Undefined(), errors.New("nil big float")
+	}
+
+	fn, err := ctx.helper("bigFloat", `(BigFloat, parseFloat, BigFloatEnv, text, prec, rnd) => {
+		if (text === "+Inf" || text === "-Inf") return BigFloat(text === "+Inf" ? Infinity : -Infinity);
+		return parseFloat(text, 16, new BigFloatEnv(prec, BigFloatEnv[rnd]));
+	}`)
+	if err != nil {
+		return fn, err
+	}
+
+	prec := v.Prec()
+	if prec < 2 {
+		prec = 2
+	}
+
+	ctor, parseFloat, env := ctx.intrinsic("BigFloat"), ctx.intrinsic("BigFloat.parseFloat"), ctx.intrinsic("BigFloatEnv")
+	defer ctor.Free()
+	defer parseFloat.Free()
+	defer env.Free()
+
+	text, precision, mode := ctx.String(bigFloatHex(v)), ctx.Uint32(uint32(prec)), ctx.String(bigFloatRoundingModes[v.Mode()])
+	defer text.Free()
+	defer mode.Free()
+
+	return ctx.Call(ctx.Undefined(), fn, []Value{ctor, parseFloat, env, text, precision, mode})
+}
+
+// bigFloatHex formats v as an integer hexadecimal mantissa with a binary
+// exponent, which libbf parses without rounding.
+func bigFloatHex(v *big.Float) string {
+	if v.IsInf() {
+		if v.Signbit() {
+			return "-Inf"
+		}
+		return "+Inf"
+	}
+
+	sign := ""
+	if v.Signbit() {
+		sign = "-"
+	}
+	if v.Sign() == 0 {
+		return sign + "0"
+	}
+
+	mant := new(big.Float)
+	exp := v.MantExp(mant)
+	mant.SetMantExp(mant.Abs(mant), int(v.Prec()))
+
+	digits, _ := mant.Int(nil)
+	return fmt.Sprintf("%s0x%sp%d", sign, digits.Text(16), exp-int(v.Prec()))
+}
+
+// BigDecimal parses a decimal string such as "-12.5e3" into a BigDecimal.
+func (ctx *Context) BigDecimal(v string) (Value, error) {
+	fn := ctx.intrinsic("BigDecimal")
+	defer fn.Free()
+
+	text := ctx.String(v)
+	defer text.Free()
+
+	return ctx.Call(ctx.Undefined(), fn, []Value{text})
+}
+
 func (ctx *Context) Float64(v float64) Value {
 	return Value{ctx: ctx, ref: C.JS_NewFloat64(ctx.ref, C.double(v))}
 }
@@ -371,6 +651,25 @@ func (ctx *Context) Atom(v string) Atom {
 	return Atom{ctx: ctx, ref: C.JS_NewAtom(ctx.ref, ptr)}
 }
 
+func (ctx *Context) Symbol(description string) Value {
+	symbol := ctx.intrinsic("Symbol")
+	defer symbol.Free()
+
+	args := []C.JSValue{ctx.String(description).ref}
+	defer C.JS_FreeValue(ctx.ref, args[0])
+
+	return Value{ctx: ctx, ref: C.JS_Call(ctx.ref, symbol.ref, C.JS_NewUndefined(), C.int(len(args)), &args[0])}
+}
+
+func (ctx *Context) SymbolIterator() Value      { return ctx.wellKnownSymbol("iterator") }
+func (ctx *Context) SymbolAsyncIterator() Value { return ctx.wellKnownSymbol("asyncIterator") }
+func (ctx *Context) SymbolToPrimitive() Value   { return ctx.wellKnownSymbol("toPrimitive") }
+func (ctx *Context) SymbolToStringTag() Value   { return ctx.wellKnownSymbol("toStringTag") }
+
+func (ctx *Context) wellKnownSymbol(name string) Value {
+	return ctx.intrinsic("Symbol." + name)
+}
+
 func (ctx *Context) eval(code string) Value { return ctx.evalFile(code, 0, "<code>") }
 
 func (ctx *Context) evalFile(code string, evaltype int, filename string) Value {
@@ -388,6 +687,7 @@ func (ctx *Context) Eval(code string, evaltype int) (Value, error) {
 }
 
 func (ctx *Context) EvalFile(code string, evaltype int, filename string) (Value, error) {
+	ctx.Runtime().resetConditions()
 	val := ctx.evalFile(code, evaltype, filename)
 
 	if val.IsException() {
@@ -397,6 +697,7 @@ func (ctx *Context) EvalFile(code string, evaltype int, filename string) (Value,
 }
 
 func (ctx *Context) Call(this Value, fn Value, args []Value) (Value, error) {
+	ctx.Runtime().resetConditions()
 	val := ctx.JsFunction(this, fn, args)
 	if val.IsException() {
 		err := ctx.Exception()
@@ -458,10 +759,28 @@ func (ctx *Context) ThrowInternalError(format string, args ...interface{}) Value
 }
 
 func (ctx *Context) Exception() error {
+	// read before converting the exception runs any code
+	conditions := ctx.Runtime().conditions()
+
 	val := Value{ctx: ctx, ref: C.JS_GetException(ctx.ref)}
 
 	defer val.Free()
-	return val.Error()
+
+	if data, ok := val.attached(); ok {
+		if p, ok := data.(*PanicError); ok {
+			if ctx.repanic {
+				panic(p)
+			}
+			return p
+		}
+	}
+	if err := val.Error(); err != nil {
+		if jsErr, ok := err.(*Error); ok {
+			jsErr.setInternal(conditions)
+		}
+		return err
+	}
+	return val.thrownValue()
 }
 
 func (ctx *Context) Object() Value {
@@ -550,26 +869,132 @@ func (v Value) Float64() float64 {
 	return float64(val)
 }
 
-func (v Value) BigInt() *big.Int {
-	if !v.IsBigInt() {
-		return nil
+// BigInt converts BigInt values, integral numbers and integer strings (with
+// an optional sign and 0x, 0o or 0b prefix) to a big.Int.
+func (v Value) BigInt() (*big.Int, error) {
+	switch {
+	case v.IsBigInt():
+		val, ok := new(big.Int).SetString(v.String(), 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid bigint %q", v.String())
+		}
+		return val, nil
+	case v.IsNumber():
+		f := v.Float64()
+		if math.IsNaN(f) || math.IsInf(f, 0) || f != math.Trunc(f) {
+			return nil, fmt.Errorf("number %v is not an integer", f)
+		}
+		val, _ := big.NewFloat(f).Int(nil)
+		return val, nil
+	case v.IsString():
+		val, ok := new(big.Int).SetString(strings.TrimSpace(v.String()), 0)
+		if !ok {
+			return nil, fmt.Errorf("invalid integer %q", v.String())
+		}
+		return val, nil
 	}
-	val, ok := new(big.Int).SetString(v.String(), 10)
-	if !ok {
-		return nil
+	return nil, errors.New("value can not be converted to a big integer")
+}
+
+// BigFloat converts BigFloat, BigDecimal, BigInt, number and numeric string
+// values to a big.Float. BigFloat and BigInt values are converted exactly.
+func (v Value) BigFloat() (*big.Float, error) {
+	switch {
+	case v.IsNumber():
+		f := v.Float64()
+		if math.IsNaN(f) {
+			return nil, errors.New("NaN can not be represented as a big float")
+		}
+		return big.NewFloat(f), nil
+	case v.IsBigFloat():
+		return v.exactBigFloat()
+	case v.IsBigInt():
+		i, err := v.BigInt()
+		if err != nil {
+			return nil, err
+		}
+		prec := uint(i.BitLen())
+		if prec < 64 {
+			prec = 64
+		}
+		return new(big.Float).SetPrec(prec).SetInt(i), nil
+	case !v.IsBigDecimal() && !v.IsString():
+		return nil, errors.New("value can not be converted to a big float")
 	}
-	return val
+
+	text := strings.TrimSpace(v.String())
+	switch text {
+	case "NaN":
+		return nil, errors.New("NaN can not be represented as a big float")
+	case "Infinity", "+Infinity", "-Infinity":
+		text = strings.TrimSuffix(text, "inity")
+	}
+
+	// decimal fractions have no exact binary form; every digit carries less
+	// than four bits, which keeps them as precise as their text
+	prec := uint(len(text)) * 4
+	if prec < 64 {
+		prec = 64
+	}
+
+	val, _, err := big.ParseFloat(text, 0, prec, big.ToNearestEven)
+	if err != nil {
+		return nil, fmt.Errorf("invalid big float %q: %w", text, err)
+	}
+	return val, nil
 }
 
-func (v Value) BigFloat() *big.Float {
-	if !v.IsBigDecimal() && !v.IsBigFloat() {
-		return nil
+// exactBigFloat converts a BigFloat through its hexadecimal form, which
+// QuickJS prints with every bit of the mantissa, as in "-1.8p3" or "c.8".
+func (v Value) exactBigFloat() (*big.Float, error) {
+	toString := v.ctx.intrinsic("BigFloat.prototype.toString")
+	defer toString.Free()
+
+	radix := v.ctx.Int32(16)
+	result, err := v.ctx.Call(v, toString, []Value{radix})
+	defer result.Free()
+
+	if err != nil {
+		return nil, err
 	}
-	val, ok := new(big.Float).SetString(v.String())
-	if !ok {
-		return nil
+
+	text := result.String()
+	switch text {
+	case "NaN":
+		return nil, errors.New("NaN can not be represented as a big float")
+	case "Infinity", "-Infinity":
+		return new(big.Float).SetInf(text[0] == '-'), nil
 	}
-	return val
+
+	sign := ""
+	if strings.HasPrefix(text, "-") {
+		sign, text = "-", text[1:]
+	}
+
+	mantissa := text
+	if i := strings.IndexByte(text, 'p'); i >= 0 {
+		mantissa = text[:i]
+	} else {
+		text += "p0"
+	}
+
+	// four bits per hexadecimal digit hold the mantissa exactly
+	prec := uint(len(strings.Replace(mantissa, ".", "", 1))) * 4
+	if prec < 64 {
+		prec = 64
+	}
+
+	val, _, err := big.ParseFloat(sign+"0x"+text, 0, prec, big.ToNearestEven)
+	if err != nil {
+		return nil, fmt.Errorf("invalid big float %q: %w", result.String(), err)
+	}
+	return val, nil
+}
+
+// Atom converts v to a property key, which makes symbols usable with
+// GetByAtom, SetByAtom and DefinePropertyByAtom. The atom must be freed.
+func (v Value) Atom() Atom {
+	return Atom{ctx: v.ctx, ref: C.JS_ValueToAtom(v.ctx.ref, v.ref)}
 }
 
 func (v Value) Get(name string) Value {
@@ -586,36 +1011,138 @@ func (v Value) GetByUint32(idx uint32) Value {
 	return Value{ctx: v.ctx, ref: C.JS_GetPropertyUint32(v.ctx.ref, v.ref, C.uint32_t(idx))}
 }
 
-func (v Value) SetByAtom(atom Atom, val Value) {
-	C.JS_SetProperty(v.ctx.ref, v.ref, atom.ref, val.ref)
+func (v Value) SetByAtom(atom Atom, val Value) error {
+	return v.setResult(C.JS_SetProperty(v.ctx.ref, v.ref, atom.ref, val.ref))
 }
 
-func (v Value) SetByInt64(idx int64, val Value) {
-	C.JS_SetPropertyInt64(v.ctx.ref, v.ref, C.int64_t(idx), val.ref)
+func (v Value) SetByInt64(idx int64, val Value) error {
+	return v.setResult(C.JS_SetPropertyInt64(v.ctx.ref, v.ref, C.int64_t(idx), val.ref))
 }
 
-func (v Value) SetByUint32(idx uint32, val Value) {
-	C.JS_SetPropertyUint32(v.ctx.ref, v.ref, C.uint32_t(idx), val.ref)
+func (v Value) SetByUint32(idx uint32, val Value) error {
+	return v.setResult(C.JS_SetPropertyUint32(v.ctx.ref, v.ref, C.uint32_t(idx), val.ref))
 }
 
 func (v Value) Len() int64 { return v.Get("length").Int64() }
 
-func (v Value) Set(name string, val Value) {
+func (v Value) Set(name string, val Value) error {
 	namePtr := C.CString(name)
 	defer C.free(unsafe.Pointer(namePtr))
-	C.JS_SetPropertyStr(v.ctx.ref, v.ref, namePtr, val.ref)
+	return v.setResult(C.JS_SetPropertyStr(v.ctx.ref, v.ref, namePtr, val.ref))
 }
 
-func (v Value) SetFunction(name string, fn Function) {
-	v.Set(name, v.ctx.Function(fn))
+func (v Value) SetFunction(name string, fn Function) error {
+	return v.Set(name, v.ctx.NamedFunction(name, 0, fn))
+}
+
+func (v Value) setResult(result C.int) error {
+	if result < 0 {
+		return v.ctx.Exception()
+	}
+	return nil
+}
+
+// Delete removes the named own property, reporting false if it is not
+// configurable.
+func (v Value) Delete(name string) (bool, error) {
+	atom := v.ctx.Atom(name)
+	defer atom.Free()
+
+	return v.DeleteByAtom(atom)
+}
+
+func (v Value) DeleteByAtom(atom Atom) (bool, error) {
+	result := C.JS_DeleteProperty(v.ctx.ref, v.ref, atom.ref, C.int(0))
+	if result < 0 {
+		return false, v.ctx.Exception()
+	}
+	return result == 1, nil
+}
+
+// Has reports whether the named property exists on v or its prototype chain.
+func (v Value) Has(name string) (bool, error) {
+	atom := v.ctx.Atom(name)
+	defer atom.Free()
+
+	return v.HasByAtom(atom)
 }
 
+func (v Value) HasByAtom(atom Atom) (bool, error) {
+	if !v.IsObject() {
+		return false, errors.New("value is not an object")
+	}
+
+	result := C.JS_HasProperty(v.ctx.ref, v.ref, atom.ref)
+	if result < 0 {
+		return false, v.ctx.Exception()
+	}
+	return result == 1, nil
+}
+
+func (v Value) IsExtensible() (bool, error) {
+	result := C.JS_IsExtensible(v.ctx.ref, v.ref)
+	if result < 0 {
+		return false, v.ctx.Exception()
+	}
+	return result == 1, nil
+}
+
+func (v Value) PreventExtensions() error {
+	result := C.JS_PreventExtensions(v.ctx.ref, v.ref)
+	if result < 0 {
+		return v.ctx.Exception()
+	}
+	if result == 0 {
+		return errors.New("object can not be made non-extensible")
+	}
+	return nil
+}
+
+func (v Value) Freeze() error { return v.integrity("Object.freeze") }
+
+func (v Value) Seal() error { return v.integrity("Object.seal") }
+
+// integrity applies the intrinsic Object.freeze or Object.seal to v.
+func (v Value) integrity(path string) error {
+	if !v.IsObject() {
+		return errors.New("value is not an object")
+	}
+
+	fn := v.ctx.intrinsic(path)
+	defer fn.Free()
+
+	result, err := v.ctx.Call(v.ctx.Undefined(), fn, []Value{v})
+	result.Free()
+	return err
+}
+
+// Error describes a JavaScript Error object. It matches the sentinel of its
+// built-in class, such as ErrTypeError, with errors.Is.
 type Error struct {
 	Cause      string
+	Name       string
 	Message    string
 	FileName   string
 	LineNumber string
 	Stack      string
+
+	// Line and Column locate the error, from lineNumber or else the innermost
+	// stack frame with a source location. They are 0 if unknown; QuickJS
+	// does not track columns, so Column is only set by stacks which have them.
+	Line   int
+	Column int
+	Frames []StackFrame
+
+	// Errors holds the errors of an AggregateError, converted with
+	// Value.Error; entries which are not Error objects are nil.
+	Errors []error
+
+	// Code is the code property of the error, if it is a string.
+	Code string
+
+	class    error
+	internal error
+	goErr    error
 }
 
 func (err Error) String() string {
@@ -624,6 +1151,10 @@ func (err Error) String() string {
 
 func (err Error) Error() string { return err.Cause }
 
+// Unwrap returns the Go error the JavaScript error was created from by
+// Context.Error, if any.
+func (err *Error) Unwrap() error { return err.goErr }
+
 func (v Value) Error() error {
 	if !v.IsError() {
 		return nil
@@ -631,6 +1162,9 @@ func (v Value) Error() error {
 
 	cause := v.String()
 
+	name := v.Get("name")
+	defer name.Free()
+
 	message := v.Get("message")
 	defer message.Free()
 
@@ -643,10 +1177,25 @@ func (v Value) Error() error {
 	stack := v.Get("stack")
 	defer stack.Free()
 
-	if stack.IsUndefined() {
-		return &Error{Cause: cause}
+	code := v.Get("code")
+	defer code.Free()
+
+	err := &Error{Cause: cause, Name: name.String(), Message: message.String()}
+	if code.IsString() {
+		err.Code = code.String()
 	}
-	return &Error{Cause: cause, Message: message.String(), FileName: filename.String(), LineNumber: linenumber.String(), Stack: stack.String()}
+	if data, ok := v.attached(); ok {
+		err.goErr, _ = data.(error)
+	}
+	if !stack.IsUndefined() {
+		err.FileName = filename.String()
+		err.LineNumber = linenumber.String()
+		err.Stack = stack.String()
+		err.Frames = parseStack(err.Stack)
+		err.locate(linenumber)
+	}
+	v.classify(err)
+	return err
 }
 
 func (v Value) IsNumber() bool        { return C.JS_IsNumber(v.ref) == 1 }
@@ -667,6 +1216,103 @@ func (v Value) IsError() bool       { return C.JS_IsError(v.ctx.ref, v.ref) == 1
 func (v Value) IsFunction() bool    { return C.JS_IsFunction(v.ctx.ref, v.ref) == 1 }
 func (v Value) IsConstructor() bool { return C.JS_IsConstructor(v.ctx.ref, v.ref) == 1 }
 
+// New calls v as a constructor, like `new v(...args)`.
+func (v Value) New(args ...Value) (Value, error) {
+	if !v.IsConstructor() {
+		return v.ctx.Undefined(), errors.New("value is not a constructor")
+	}
+
+	argc, argv := valueRefs(args)
+	return v.result(C.JS_CallConstructor(v.ctx.ref, v.ref, argc, argv))
+}
+
+// NewWithTarget calls v as a constructor with an explicit new.target, like
+// `Reflect.construct(v, args, newTarget)`.
+func (v Value) NewWithTarget(newTarget Value, args ...Value) (Value, error) {
+	if !v.IsConstructor() || !newTarget.IsConstructor() {
+		return v.ctx.Undefined(), errors.New("value is not a constructor")
+	}
+
+	argc, argv := valueRefs(args)
+	return v.result(C.JS_CallConstructor2(v.ctx.ref, v.ref, newTarget.ref, argc, argv))
+}
+
+// Invoke calls the named method of v with v as this, like `v[method](...args)`.
+func (v Value) Invoke(method string, args ...Value) (Value, error) {
+	atom := v.ctx.Atom(method)
+	defer atom.Free()
+
+	argc, argv := valueRefs(args)
+	return v.result(C.JS_Invoke(v.ctx.ref, v.ref, atom.ref, argc, argv))
+}
+
+func (v Value) result(ref C.JSValue) (Value, error) {
+	val := Value{ctx: v.ctx, ref: ref}
+	if val.IsException() {
+		return val, v.ctx.Exception()
+	}
+	return val, nil
+}
+
+func (v Value) StrictEquals(other Value) bool {
+	result, err := v.compare("strictEquals", `(a, b) => a === b`, other)
+	return err == nil && result
+}
+
+func (v Value) SameValue(other Value) bool {
+	is := v.ctx.intrinsic("Object.is")
+	defer is.Free()
+
+	result, err := v.ctx.Call(v.ctx.Undefined(), is, []Value{v, other})
+	defer result.Free()
+	return err == nil && result.Bool()
+}
+
+// LooseEquals compares using ==, which may call valueOf or toString and
+// therefore fail.
+func (v Value) LooseEquals(other Value) (bool, error) {
+	return v.compare("looseEquals", `(a, b) => a == b`, other)
+}
+
+func (v Value) compare(name, code string, other Value) (bool, error) {
+	fn, err := v.ctx.helper(name, code)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := v.ctx.Call(v.ctx.Undefined(), fn, []Value{v, other})
+	defer result.Free()
+
+	if err != nil {
+		return false, err
+	}
+	return result.Bool(), nil
+}
+
+func (v Value) InstanceOf(ctor Value) (bool, error) {
+	result := C.JS_IsInstanceOf(v.ctx.ref, v.ref, ctor.ref)
+	if result < 0 {
+		return false, v.ctx.Exception()
+	}
+	return result == 1, nil
+}
+
+// Prototype returns the prototype of v, or null. The result must be freed.
+func (v Value) Prototype() (Value, error) {
+	proto := Value{ctx: v.ctx, ref: C.JS_GetPrototype(v.ctx.ref, v.ref)}
+	if proto.IsException() {
+		return proto, v.ctx.Exception()
+	}
+	return proto, nil
+}
+
+func (v Value) SetPrototype(proto Value) error {
+	if C.JS_SetPrototype(v.ctx.ref, v.ref, proto.ref) < 0 {
+		return v.ctx.Exception()
+	}
+	return nil
+}
+
 type PropertyEnum struct {
 	IsEnumerable bool
 	Atom         Atom
@@ -717,6 +1363,72 @@ type PropertyDescriptor struct {
 	Setter *Value
 }
 
+// Free releases the values of a descriptor returned by
+// GetOwnPropertyDescriptor.
+func (desc PropertyDescriptor) Free() {
+	for _, val := range []*Value{desc.Value, desc.Getter, desc.Setter} {
+		if val != nil {
+			val.Free()
+		}
+	}
+}
+
+// GetOwnPropertyDescriptor looks up an own property of v, reporting false if
+// it does not exist. The returned descriptor must be freed.
+func (v Value) GetOwnPropertyDescriptor(name string) (PropertyDescriptor, bool, error) {
+	atom := v.ctx.Atom(name)
+	defer atom.Free()
+
+	return v.GetOwnPropertyDescriptorByAtom(atom)
+}
+
+func (v Value) GetOwnPropertyDescriptorByAtom(atom Atom) (PropertyDescriptor, bool, error) {
+	if !v.IsObject() {
+		return PropertyDescriptor{}, false, errors.New("value is not an object")
+	}
+
+	var desc C.JSPropertyDescriptor
+
+	result := C.JS_GetOwnProperty(v.ctx.ref, &desc, v.ref, atom.ref)
+	if result < 0 {
+		return PropertyDescriptor{}, false, v.ctx.Exception()
+	}
+	if result == 0 {
+		return PropertyDescriptor{}, false, nil
+	}
+
+	flags := int(desc.flags)
+	value := Value{ctx: v.ctx, ref: desc.value}
+	getter := Value{ctx: v.ctx, ref: desc.getter}
+	setter := Value{ctx: v.ctx, ref: desc.setter}
+
+	prop := PropertyDescriptor{
+		IsConfigurable: PropertyOption(flags&C.JS_PROP_CONFIGURABLE != 0),
+		IsEnumerable:   PropertyOption(flags&C.JS_PROP_ENUMERABLE != 0),
+	}
+
+	if flags&C.JS_PROP_GETSET != 0 {
+		value.Free()
+		if getter.IsFunction() {
+			prop.Getter = &getter
+		} else {
+			getter.Free()
+		}
+		if setter.IsFunction() {
+			prop.Setter = &setter
+		} else {
+			setter.Free()
+		}
+	} else {
+		getter.Free()
+		setter.Free()
+		prop.Value = &value
+		prop.IsWritable = PropertyOption(flags&C.JS_PROP_WRITABLE != 0)
+	}
+
+	return prop, true, nil
+}
+
 func (v Value) DefineProperty(name string, desc PropertyDescriptor) error {
 
 	// common
@@ -724,6 +1436,13 @@ func (v Value) DefineProperty(name string, desc PropertyDescriptor) error {
 		return errors.New("property must have a name")
 	}
 
+	atom := v.ctx.Atom(name)
+	defer atom.Free()
+
+	return v.DefinePropertyByAtom(atom, desc)
+}
+
+func (v Value) DefinePropertyByAtom(atom Atom, desc PropertyDescriptor) error {
 	// data or accessor descriptor ?
 	isData := desc.Value != nil || desc.IsWritable != nil
 	isAccessor := desc.Getter != nil || desc.Setter != nil
@@ -784,9 +1503,11 @@ func (v Value) DefineProperty(name string, desc PropertyDescriptor) error {
 		}
 	}
 
-	atom := v.ctx.Atom(name)
 	result := int(C.JS_DefineProperty(v.ctx.ref, v.ref, atom.ref, value, getter, setter, C.int(flags)))
 	if result < 0 {
+		return v.ctx.Exception()
+	}
+	if result == 0 {
 		return errors.New("error defining the property descriptor")
 	}
 	return nil
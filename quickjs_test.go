@@ -1,9 +1,14 @@
 package quickjs
 
 import (
+	gocontext "context"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	osruntime "runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -163,8 +168,22 @@ func TestMemoryLimit(t *testing.T) {
 
 	if assert.Error(t, err, "expected a memory limit violation") {
 		require.Equal(t, "InternalError: out of memory", err.Error())
+		require.True(t, errors.Is(err, ErrOutOfMemory))
+		require.True(t, errors.Is(err, ErrInternalError))
 	}
 	result.Free()
+
+	// an out of memory error caught by a script is not reported for the
+	// exceptions of later calls
+	result, err = context.Eval(`array = null; try { const more = []; while (true) { more.push(null) } } catch (e) {} "caught"`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, "caught", result.String())
+	result.Free()
+
+	result, err = context.Eval(`throw new InternalError("out of memory")`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, ErrInternalError))
+	require.False(t, errors.Is(err, ErrOutOfMemory))
 }
 
 func checkProperty(t *testing.T, ctx *Context, obj Value, desc PropertyDescriptor, propName, propValue, code string) {
@@ -237,3 +256,1726 @@ func TestDefineProperty(t *testing.T) {
 	}
 	checkProperty(t, context, jsObj, prop, propName, propValue, "obj.%s === '%s'")
 }
+
+func TestIterate(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	gen, err := context.Eval(`
+		var closed = false;
+		(function* () { try { yield 1; yield 2; yield 3; } finally { closed = true; } })()
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer gen.Free()
+
+	var seen []int64
+	err = gen.Iterate(func(v Value) (bool, error) {
+		seen = append(seen, v.Int64())
+		return len(seen) < 2, nil
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, []int64{1, 2}, seen)
+
+	closed, err := context.Eval(`closed`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer closed.Free()
+	require.True(t, closed.Bool())
+
+	m, err := context.Eval(`new Map([["a", 1], ["b", 2]])`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer m.Free()
+
+	entries, err := m.MapEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.EqualValues(t, "a", entries[0].Key.String())
+	require.EqualValues(t, 2, entries[1].Value.Int64())
+	for _, entry := range entries {
+		entry.Free()
+	}
+
+	badEntry, err := context.Eval(`({ *[Symbol.iterator]() { yield { get 1() { throw new RangeError("entry"); } }; } })`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer badEntry.Free()
+
+	_, err = badEntry.MapEntries()
+	require.Error(t, err)
+	require.EqualValues(t, "RangeError: entry", err.Error())
+
+	s, err := context.Eval(`new Set(["x", "y", "x"])`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer s.Free()
+
+	values, err := s.SetValues()
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	for _, value := range values {
+		value.Free()
+	}
+
+	thrower, err := context.Eval(`({ [Symbol.iterator]() { return { next() { throw new TypeError("broken"); } }; } })`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer thrower.Free()
+
+	err = thrower.Iterate(func(v Value) (bool, error) { return true, nil })
+	require.Error(t, err)
+	require.EqualValues(t, "TypeError: broken", err.Error())
+
+	for name, code := range map[string]string{
+		"done":  `({ [Symbol.iterator]() { return { next() { return { get done() { throw new RangeError("done"); } }; } }; } })`,
+		"value": `({ [Symbol.iterator]() { return { next() { return { done: false, get value() { throw new RangeError("value"); } }; } }; } })`,
+	} {
+		getter, err := context.Eval(code, EVAL_GLOBAL)
+		require.NoError(t, err, name)
+
+		calls := 0
+		err = getter.Iterate(func(v Value) (bool, error) { calls++; return true, nil })
+		getter.Free()
+		require.Error(t, err, name)
+		require.EqualValues(t, "RangeError: "+name, err.Error())
+		require.Zero(t, calls, name)
+	}
+
+	num := context.Int32(1)
+	require.Error(t, num.Iterate(func(v Value) (bool, error) { return true, nil }))
+}
+
+func TestSymbol(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	secret := context.Symbol("secret")
+	defer secret.Free()
+	require.True(t, secret.IsSymbol())
+
+	atom := secret.Atom()
+	defer atom.Free()
+
+	obj := context.Object()
+	obj.SetByAtom(atom, context.String("hidden"))
+	context.Globals().Set("obj", obj)
+	context.Globals().Set("secret", context.DupValue(secret))
+
+	value := obj.GetByAtom(atom)
+	defer value.Free()
+	require.EqualValues(t, "hidden", value.String())
+
+	tagKey := context.SymbolToStringTag()
+	defer tagKey.Free()
+
+	tagAtom := tagKey.Atom()
+	defer tagAtom.Free()
+
+	tag := context.String("Account")
+	require.NoError(t, obj.DefinePropertyByAtom(tagAtom, PropertyDescriptor{Value: &tag}))
+
+	result, err := context.Eval(`obj[secret] === "hidden" && Object.keys(obj).length === 0 && String(obj) === "[object Account]"`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.True(t, result.Bool())
+
+	// scripts replacing Symbol can not spoof the symbols used from Go
+	spoof, err := context.Eval(`globalThis.Symbol = { iterator: "fake", toStringTag: "fake" }; [1, 2]`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer spoof.Free()
+
+	iterator := context.SymbolIterator()
+	defer iterator.Free()
+	require.True(t, iterator.IsSymbol())
+
+	created := context.Symbol("created")
+	defer created.Free()
+	require.True(t, created.IsSymbol())
+
+	count := 0
+	require.NoError(t, spoof.Iterate(func(v Value) (bool, error) { count++; return true, nil }))
+	require.EqualValues(t, 2, count)
+}
+
+func TestValueType(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	cases := map[string]ValueType{
+		`undefined`:                    TypeUndefined,
+		`null`:                         TypeNull,
+		`true`:                         TypeBoolean,
+		`1.5`:                          TypeNumber,
+		`1n`:                           TypeBigInt,
+		`"str"`:                        TypeString,
+		`Symbol()`:                     TypeSymbol,
+		`(() => 1)`:                    TypeFunction,
+		`({})`:                         TypeObject,
+		`[1, 2]`:                       TypeArray,
+		`new Date(0)`:                  TypeDate,
+		`/a+/g`:                        TypeRegExp,
+		`Promise.resolve(1)`:           TypePromise,
+		`new Map()`:                    TypeMap,
+		`new Set()`:                    TypeSet,
+		`new ArrayBuffer(8)`:           TypeArrayBuffer,
+		`new Float64Array(2)`:          TypeTypedArray,
+		`new RangeError("x")`:          TypeError,
+		`new Proxy([], {})`:            TypeProxy,
+		`Object.create(Map.prototype)`: TypeObject,
+	}
+
+	for code, expected := range cases {
+		value, err := context.Eval(code, EVAL_GLOBAL)
+		require.NoError(t, err, code)
+		require.Equal(t, expected, value.Type(), code)
+		value.Free()
+	}
+	require.Equal(t, "object", TypeArray.TypeOf())
+
+	for code, expected := range map[string]string{
+		`new Proxy(function() {}, {})`: "function",
+		`new Proxy({}, {})`:            "object",
+		`1n`:                           "bigint",
+	} {
+		value, err := context.Eval(code, EVAL_GLOBAL)
+		require.NoError(t, err, code)
+		require.Equal(t, expected, value.TypeOf(), code)
+		value.Free()
+	}
+
+	// every typed array class id is pinned
+	for _, ctor := range []string{"Int8Array", "Uint8Array", "Uint8ClampedArray", "Int16Array", "Uint16Array",
+		"Int32Array", "Uint32Array", "BigInt64Array", "BigUint64Array", "Float32Array", "Float64Array"} {
+		value, err := context.Eval(`new `+ctor+`(1)`, EVAL_GLOBAL)
+		require.NoError(t, err, ctor)
+		require.Equal(t, TypeTypedArray, value.Type(), ctor)
+		value.Free()
+	}
+
+	// replaced globals do not change how objects are classified
+	spoofed := runtime.NewContext()
+	defer spoofed.Free()
+
+	value, err := spoofed.Eval(`const date = new Date(0), map = new Map();
+		globalThis.Map = globalThis.Date = globalThis.Proxy = undefined;
+		[date, map]`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	date, m := value.GetByUint32(0), value.GetByUint32(1)
+	require.Equal(t, TypeDate, date.Type())
+	require.Equal(t, TypeMap, m.Type())
+	date.Free()
+	m.Free()
+	value.Free()
+
+	values, err := context.Eval(`class Base {}; [new Base(), Base, 1, "1", NaN]`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer values.Free()
+
+	instance, base := values.GetByUint32(0), values.GetByUint32(1)
+	defer instance.Free()
+	defer base.Free()
+
+	ok, err := instance.InstanceOf(base)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	proto, err := instance.Prototype()
+	require.NoError(t, err)
+	defer proto.Free()
+
+	baseProto := base.Get("prototype")
+	defer baseProto.Free()
+	require.True(t, proto.StrictEquals(baseProto))
+
+	plain := context.Object()
+	defer plain.Free()
+	require.NoError(t, plain.SetPrototype(baseProto))
+	ok, err = plain.InstanceOf(base)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	one, oneString, nan := values.GetByUint32(2), values.GetByUint32(3), values.GetByUint32(4)
+	defer one.Free()
+	defer oneString.Free()
+	defer nan.Free()
+
+	require.False(t, one.StrictEquals(oneString))
+	equal, err := one.LooseEquals(oneString)
+	require.NoError(t, err)
+	require.True(t, equal)
+	require.False(t, nan.StrictEquals(nan))
+	require.True(t, nan.SameValue(nan))
+
+	// scripts replacing Object.is do not change the comparison
+	result, err := context.Eval(`Object.is = () => true`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+	require.False(t, one.SameValue(oneString))
+}
+
+func TestPropertyAPI(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	obj, err := context.Eval(`({
+		a: 1,
+		get b() { return 2; },
+		set c(v) { throw new Error("c is read-only"); },
+	})`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer obj.Free()
+
+	ok, err := obj.Has("a")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = obj.Has("toString")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	desc, ok, err := obj.GetOwnPropertyDescriptor("a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NotNil(t, desc.Value)
+	require.EqualValues(t, 1, desc.Value.Int32())
+	require.True(t, *desc.IsWritable && *desc.IsEnumerable && *desc.IsConfigurable)
+	desc.Free()
+
+	desc, ok, err = obj.GetOwnPropertyDescriptor("b")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NotNil(t, desc.Getter)
+	require.Nil(t, desc.Setter)
+	desc.Free()
+
+	_, ok, err = obj.GetOwnPropertyDescriptor("missing")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	err = obj.Set("c", context.Int32(3))
+	require.Error(t, err)
+	require.EqualValues(t, "Error: c is read-only", err.Error())
+
+	ok, err = obj.Delete("a")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = obj.Has("a")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, obj.Freeze())
+
+	ok, err = obj.IsExtensible()
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	err = obj.Set("d", context.Int32(4))
+	require.Error(t, err)
+
+	ok, err = obj.Delete("b")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// scripts replacing Object.seal do not change Seal
+	result, err := context.Eval(`Object.seal = obj => obj`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	sealed := context.Object()
+	defer sealed.Free()
+	require.NoError(t, sealed.Set("x", context.Int32(1)))
+	require.NoError(t, sealed.Seal())
+	require.NoError(t, sealed.Set("x", context.Int32(2)))
+	require.Error(t, sealed.Set("y", context.Int32(3)))
+
+	fixed := context.Object()
+	defer fixed.Free()
+	require.NoError(t, fixed.PreventExtensions())
+	require.Error(t, fixed.SetByUint32(0, context.Int32(1)))
+}
+
+func TestBigNumbers(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	huge, ok := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	require.True(t, ok)
+
+	hugeValue, err := context.BigInt(huge)
+	require.NoError(t, err)
+	context.Globals().Set("huge", hugeValue)
+	context.Globals().Set("small", context.BigInt64(-5))
+
+	_, err = context.BigInt(nil)
+	require.Error(t, err)
+	_, err = context.BigFloat(nil)
+	require.Error(t, err)
+
+	exact, _, err := big.ParseFloat("1.25e-30", 10, 200, big.ToZero)
+	require.NoError(t, err)
+	exactValue, err := context.BigFloat(exact)
+	require.NoError(t, err)
+	context.Globals().Set("exact", exactValue)
+
+	decimal, err := context.BigDecimal("-12.5")
+	require.NoError(t, err)
+	context.Globals().Set("decimal", decimal)
+
+	_, err = context.BigDecimal("not a number")
+	require.Error(t, err)
+
+	result, err := context.Eval(`[huge * 2n, small, exact, decimal * 2m, "-0x1f"]`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+
+	doubled := result.GetByUint32(0)
+	defer doubled.Free()
+	require.True(t, doubled.IsBigInt())
+
+	value, err := doubled.BigInt()
+	require.NoError(t, err)
+	require.EqualValues(t, new(big.Int).Mul(huge, big.NewInt(2)).String(), value.String())
+
+	small := result.GetByUint32(1)
+	defer small.Free()
+	value, err = small.BigInt()
+	require.NoError(t, err)
+	require.EqualValues(t, -5, value.Int64())
+
+	roundTrip := result.GetByUint32(2)
+	defer roundTrip.Free()
+	require.True(t, roundTrip.IsBigFloat())
+	f, err := roundTrip.BigFloat()
+	require.NoError(t, err)
+	require.Zero(t, f.Cmp(exact), f.Text('g', 70))
+
+	// values computed in JavaScript keep every bit of their precision
+	third, err := context.Eval(`[BigFloatEnv.setPrec(() => 1l / 3l, 200), -1024l, BigFloat(1 / 0), 12345678901234567890n]`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer third.Free()
+
+	thirdValue := third.GetByUint32(0)
+	defer thirdValue.Free()
+	f, err = thirdValue.BigFloat()
+	require.NoError(t, err)
+	expected := new(big.Float).SetPrec(200).Quo(big.NewFloat(1), big.NewFloat(3))
+	require.Zero(t, f.Cmp(expected), f.Text('g', 70))
+
+	for i, text := range []string{"-1024", "+Inf", "12345678901234567890"} {
+		item := third.GetByUint32(uint32(i + 1))
+		f, err = item.BigFloat()
+		item.Free()
+		require.NoError(t, err)
+		require.EqualValues(t, text, f.Text('f', 0))
+	}
+
+	doubledDecimal := result.GetByUint32(3)
+	defer doubledDecimal.Free()
+	f, err = doubledDecimal.BigFloat()
+	require.NoError(t, err)
+	require.EqualValues(t, "-25", f.Text('f', 0))
+
+	hex := result.GetByUint32(4)
+	defer hex.Free()
+	value, err = hex.BigInt()
+	require.NoError(t, err)
+	require.EqualValues(t, -31, value.Int64())
+
+	_, err = context.Float64(1.5).BigInt()
+	require.Error(t, err)
+
+	// scripts replacing the constructors do not change the conversions
+	replaced := runtime.NewContext()
+	defer replaced.Free()
+
+	result, err = replaced.Eval(`BigInt = BigFloat = BigFloatEnv = BigDecimal = () => 0`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	for _, convert := range []func() (Value, error){
+		func() (Value, error) { return replaced.BigInt(huge) },
+		func() (Value, error) { return replaced.BigFloat(exact) },
+		func() (Value, error) { return replaced.BigDecimal("-12.5") },
+	} {
+		value, err := convert()
+		require.NoError(t, err)
+		require.False(t, value.IsNumber(), value.String())
+		value.Free()
+	}
+}
+
+func TestConstructAndInvoke(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	classes, err := context.Eval(`
+		class Point {
+			constructor(x, y) { this.x = x; this.y = y; this.kind = new.target.name; }
+			sum() { return this.x + this.y; }
+			fail() { throw new RangeError("out of range"); }
+		}
+		class Point3 extends Point {}
+		[Point, Point3]
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer classes.Free()
+
+	point, point3 := classes.GetByUint32(0), classes.GetByUint32(1)
+	defer point.Free()
+	defer point3.Free()
+
+	p, err := point.New(context.Int32(1), context.Int32(2))
+	require.NoError(t, err)
+	defer p.Free()
+
+	sum, err := p.Invoke("sum")
+	require.NoError(t, err)
+	defer sum.Free()
+	require.EqualValues(t, 3, sum.Int32())
+
+	_, err = p.Invoke("fail")
+	require.Error(t, err)
+	require.EqualValues(t, "RangeError: out of range", err.Error())
+
+	_, err = p.Invoke("missing")
+	require.Error(t, err)
+
+	q, err := point.NewWithTarget(point3, context.Int32(3), context.Int32(4))
+	require.NoError(t, err)
+	defer q.Free()
+
+	kind := q.Get("kind")
+	defer kind.Free()
+	require.EqualValues(t, "Point3", kind.String())
+
+	ok, err := q.InstanceOf(point3)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = sum.New()
+	require.Error(t, err)
+}
+
+func TestNamedFunction(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	context.Globals().Set("add", context.NamedFunction("add", 2, func(ctx *Context, this Value, args []Value) Value {
+		return ctx.Int32(args[0].Int32() + args[1].Int32())
+	}))
+
+	result, err := context.Eval(`[add.name, add.length, add(1, 2), Object.getOwnPropertyNames(add).sort().join()].join(" ")`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "add 2 3 length,name", result.String())
+
+	before := len(refs.objs)
+	for i := 0; i < 10; i++ {
+		fn := context.Function(func(ctx *Context, this Value, args []Value) Value { return ctx.Null() })
+		fn.Free()
+	}
+	runtime.RunGC()
+	require.Equal(t, before, len(refs.objs))
+}
+
+type bindOrder struct {
+	ID    int      `json:"id"`
+	Items []string `json:"items"`
+	Note  string   `js:"-"`
+}
+
+func sumAll(base int, values ...float64) float64 {
+	for _, v := range values {
+		base += int(v)
+	}
+	return float64(base)
+}
+
+func TestBind(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	sum, err := context.Bind(sumAll)
+	require.NoError(t, err)
+	context.Globals().Set("sum", sum)
+
+	describe, err := context.Bind(func(order bindOrder, tags map[string]bool) (string, error) {
+		if order.ID == 0 {
+			return "", errors.New("missing id")
+		}
+		return fmt.Sprintf("%d:%d:%v", order.ID, len(order.Items), tags["rush"]), nil
+	})
+	require.NoError(t, err)
+	context.Globals().Set("describe", describe)
+
+	apply, err := context.Bind(func(fn func(int) int, v int) (int, bool) {
+		return fn(v), true
+	})
+	require.NoError(t, err)
+	context.Globals().Set("apply", apply)
+
+	result, err := context.Eval(`[
+		sum.name, sum.length, sum(1, 2, 3.5),
+		describe({ id: 7, items: ["a", "b"] }, { rush: true }),
+		apply(x => x * 2, 21).join(),
+	].join(" ")`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "sumAll 1 6 7:2:true 42,true", result.String())
+
+	_, err = context.Eval(`describe({ id: 0 }, {})`, EVAL_GLOBAL)
+	require.Error(t, err)
+	require.EqualValues(t, "Error: missing id", err.Error())
+
+	_, err = context.Eval(`sum("one")`, EVAL_GLOBAL)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TypeError: sumAll: argument 1")
+
+	_, err = context.Eval(`describe({ id: 1, items: [1] }, {})`, EVAL_GLOBAL)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "argument 1: items: [0]: expected string, got number")
+
+	_, err = context.Bind(42)
+	require.Error(t, err)
+}
+
+func TestBindOwnership(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	// arguments are borrowed, so returning them unchanged must neither free
+	// them twice nor leak the duplicates of exported functions
+	identity, err := context.Bind(func(v Value) Value { return v })
+	require.NoError(t, err)
+	context.Globals().Set("identity", identity)
+
+	first, err := context.Bind(func(values ...interface{}) (interface{}, int) { return values[0], len(values) })
+	require.NoError(t, err)
+	context.Globals().Set("first", first)
+
+	ignore, err := context.Bind(func(v interface{}, values []Value) bool { _, ok := v.(Value); return ok && len(values) == 1 })
+	require.NoError(t, err)
+	context.Globals().Set("ignore", ignore)
+
+	result, err := context.Eval(`
+		const obj = {}, fn = () => 1, sym = Symbol("s");
+		[identity(obj) === obj, first(fn, 1)[0] === fn, first(sym)[0] === sym, ignore(fn, [obj])].join()
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "true,true,true,true", result.String())
+
+	echo := context.AsyncFunction(func(ctx gocontext.Context, args []interface{}) (interface{}, error) {
+		return args[0], nil
+	})
+	require.NoError(t, context.Globals().Set("echo", echo))
+
+	promise, err := context.Eval(`echo(fn).then(r => r === fn)`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer promise.Free()
+
+	same, err := promise.Await(gocontext.Background())
+	require.NoError(t, err)
+	defer same.Free()
+	require.True(t, same.Bool())
+}
+
+func TestFunctionPanic(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	boom := errors.New("boom")
+	context.Globals().SetFunction("explode", func(ctx *Context, this Value, args []Value) Value {
+		panic(boom)
+	})
+
+	result, err := context.Eval(`
+		let caught;
+		try { explode(); } catch (e) { caught = e instanceof InternalError && e.message === "go panic: boom" && e.goStack.length > 0; }
+		caught
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.True(t, result.Bool())
+
+	_, err = context.Eval(`explode()`, EVAL_GLOBAL)
+	require.Error(t, err)
+
+	var panicErr *PanicError
+	require.True(t, errors.As(err, &panicErr))
+	require.Equal(t, boom, panicErr.Value)
+	require.Contains(t, string(panicErr.Stack), "TestFunctionPanic")
+	require.True(t, errors.Is(err, boom))
+
+	// scripts removing InternalError do not lose the panic
+	result, err = context.Eval(`delete globalThis.InternalError`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	_, err = context.Eval(`explode()`, EVAL_GLOBAL)
+	require.True(t, errors.As(err, &panicErr))
+	require.True(t, errors.Is(err, boom))
+
+	context.SetRepanic(true)
+	require.Panics(t, func() { context.Eval(`explode()`, EVAL_GLOBAL) })
+}
+
+type testAccount struct {
+	ID      string
+	Balance int64
+}
+
+func TestDefineClass(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	finalized := make(chan string, 10)
+
+	class, err := context.DefineClass(ClassSpec{
+		Name: "Account",
+		Constructor: func(ctx *Context, args []Value) (interface{}, error) {
+			if len(args) == 0 || !args[0].IsString() {
+				return nil, errors.New("account id required")
+			}
+			return &testAccount{ID: args[0].String()}, nil
+		},
+		Methods: map[string]ClassMethod{
+			"deposit": func(ctx *Context, this interface{}, args []Value) Value {
+				account := this.(*testAccount)
+				account.Balance += args[0].Int64()
+				return ctx.Int64(account.Balance)
+			},
+		},
+		Properties: map[string]ClassProperty{
+			"id": {
+				Get: func(ctx *Context, this interface{}) Value { return ctx.String(this.(*testAccount).ID) },
+			},
+			"balance": {
+				Get: func(ctx *Context, this interface{}) Value { return ctx.Int64(this.(*testAccount).Balance) },
+				Set: func(ctx *Context, this interface{}, value Value) error {
+					if value.Int64() < 0 {
+						return errors.New("negative balance")
+					}
+					this.(*testAccount).Balance = value.Int64()
+					return nil
+				},
+			},
+		},
+		Static: map[string]Function{
+			"currency": func(ctx *Context, this Value, args []Value) Value { return ctx.String("EUR") },
+		},
+		Finalizer: func(this interface{}) {
+			finalized <- this.(*testAccount).ID
+		},
+	})
+	require.NoError(t, err)
+
+	result, err := context.Eval(`
+		class Savings extends Account {
+			interest() { return this.balance / 10; }
+		}
+		const a = new Account("a1");
+		a.deposit(5);
+		a.balance += 10;
+		const s = new Savings("s1");
+		s.deposit(100);
+		[a.id, a.balance, a instanceof Account, s instanceof Account, s.interest(), Account.currency(),
+			Object.prototype.toString.call(a), Object.keys(Account.prototype).length,
+			Object.keys(Account).length, Object.getOwnPropertyDescriptor(Account.prototype, "deposit").writable].join()
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "a1,15,true,true,10,EUR,[object Account],0,0,true", result.String())
+
+	_, err = context.Eval(`new Account()`, EVAL_GLOBAL)
+	require.Error(t, err)
+	require.EqualValues(t, "Error: account id required", err.Error())
+
+	_, err = context.Eval(`Account("x")`, EVAL_GLOBAL)
+	require.Error(t, err)
+
+	_, err = context.Eval(`Account.prototype.deposit.call({}, 1)`, EVAL_GLOBAL)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TypeError")
+
+	_, err = context.Eval(`a.balance = -1`, EVAL_GLOBAL)
+	require.Error(t, err)
+
+	// classes share their class id but not their instances
+	other, err := context.DefineClass(ClassSpec{Name: "Other"})
+	require.NoError(t, err)
+	otherInstance, err := other.NewInstance(&testAccount{ID: "other"})
+	require.NoError(t, err)
+	defer otherInstance.Free()
+	_, ok := class.Unwrap(otherInstance)
+	require.False(t, ok)
+	require.NoError(t, context.Globals().Set("other", context.DupValue(otherInstance)))
+
+	_, err = context.Eval(`Account.prototype.deposit.call(other, 1)`, EVAL_GLOBAL)
+	require.Error(t, err)
+	require.EqualValues(t, "TypeError: Account object expected", err.Error())
+
+	instance, err := class.NewInstance(&testAccount{ID: "go"})
+	require.NoError(t, err)
+	value, ok := class.Unwrap(instance)
+	require.True(t, ok)
+	require.EqualValues(t, "go", value.(*testAccount).ID)
+	instance.Free()
+
+	runtime.RunGC()
+	require.EqualValues(t, "go", <-finalized)
+}
+
+type wrapAddress struct {
+	City string `json:"city"`
+}
+
+type wrapUser struct {
+	Name    string      `js:"name"`
+	Age     int         `json:"age"`
+	Secret  string      `js:"-"`
+	Address wrapAddress `json:"address"`
+}
+
+func (u *wrapUser) Greet(greeting string) string { return greeting + ", " + u.Name }
+
+func TestWrap(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	user := &wrapUser{Name: "ann", Age: 30, Secret: "s", Address: wrapAddress{City: "Oslo"}}
+
+	obj, err := context.Wrap(user)
+	require.NoError(t, err)
+	require.NoError(t, context.Globals().Set("user", obj))
+
+	result, err := context.Eval(`
+		user.age += 1;
+		user.address.city = "Bergen";
+		[Object.keys(user).join("|"), "name" in user, "Secret" in user, user.Greet("hi"), JSON.stringify(user)].join()
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, `name|age|address,true,false,hi, ann,{"name":"ann","age":31,"address":{"city":"Bergen"}}`, result.String())
+	require.EqualValues(t, 31, user.Age)
+	require.EqualValues(t, "Bergen", user.Address.City)
+
+	user.Name = "bob"
+	result, err = context.Eval(`user.name`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, "bob", result.String())
+	result.Free()
+
+	_, err = context.Eval(`"use strict"; user.age = "old"`, EVAL_GLOBAL)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TypeError")
+
+	result, err = context.Eval(`user.unknown = 1; delete user.name; [user.unknown, user.name].join()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, ",bob", result.String())
+	result.Free()
+
+	require.Error(t, obj.Set("unknown", context.Int32(1)))
+
+	// methods and nested wrappers are made once per object
+	result, err = context.Eval(`[user.Greet === user.Greet, user.address === user.address].join()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, "true,true", result.String())
+	result.Free()
+
+	// failures are thrown into the calling context
+	other := runtime.NewContext()
+	defer other.Free()
+
+	require.NoError(t, other.Globals().Set("user", context.DupValue(obj)))
+	result, err = other.Eval(`try { user.age = "old"; } catch (e) { e instanceof TypeError }`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.True(t, result.Bool())
+	result.Free()
+
+	_, err = context.Wrap(wrapUser{})
+	require.Error(t, err)
+}
+
+func TestWrapMapAndSlice(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	config := map[string]interface{}{
+		"name":   "app",
+		"tags":   []interface{}{"a"},
+		"limits": map[string]interface{}{"cpu": 1.0},
+	}
+	ports := []int{80, 443}
+
+	obj, err := context.WrapMap(config)
+	require.NoError(t, err)
+	require.NoError(t, context.Globals().Set("config", obj))
+
+	obj, err = context.WrapSlice(&ports)
+	require.NoError(t, err)
+	require.NoError(t, context.Globals().Set("ports", obj))
+
+	result, err := context.Eval(`
+		config.name = "web";
+		config.limits.cpu = 2;
+		delete config.tags;
+		config.replicas = 3;
+		ports.push(8080);
+		ports[0] = 81;
+		const doubled = ports.map(p => p * 2);
+		[Object.keys(config).join("|"), ports.length, doubled.join("|"), JSON.stringify(ports), "tags" in config, ports.indexOf(443)].join()
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "limits|name|replicas,3,162|886|16160,[81,443,8080],false,1", result.String())
+
+	require.EqualValues(t, map[string]interface{}{
+		"name":     "web",
+		"limits":   map[string]interface{}{"cpu": 2.0},
+		"replicas": 3.0,
+	}, config)
+	require.EqualValues(t, []int{81, 443, 8080}, ports)
+
+	result, err = context.Eval(`ports.length = 2; ports.pop(); ports.length`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, result.Int64())
+	result.Free()
+	require.EqualValues(t, []int{81}, ports)
+
+	_, err = context.Eval(`ports.push("x")`, EVAL_GLOBAL)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TypeError")
+
+	result, err = context.Eval(`config.tags = ["a"]; config.tags.push("b"); [Array.isArray(ports), Array.isArray(config.tags), config.tags.length].join()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, "true,true,2", result.String())
+	result.Free()
+	require.EqualValues(t, []interface{}{"a", "b"}, config["tags"])
+
+	values := map[string]interface{}{}
+	obj, err = context.WrapMap(values)
+	require.NoError(t, err)
+	require.NoError(t, context.Globals().Set("values", obj))
+
+	// overwritten and deleted values are freed, which the runtime checks when
+	// it is freed
+	result, err = context.Eval(`values.f = () => 1; values.f = () => 2; values.g = {}; delete values.g; values.f()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, result.Int64())
+	result.Free()
+	require.Len(t, values, 1)
+	values["f"].(Value).Free()
+
+	// values put into the data by Go code are not freed when overwritten
+	owned := context.Object()
+	values["h"] = owned
+	result, err = context.Eval(`values.h = 1; values.h`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, result.Int64())
+	result.Free()
+	owned.Free()
+
+	_, err = context.WrapSlice(ports)
+	require.Error(t, err)
+
+	// scripts replacing Proxy and Reflect do not change wrapped slices
+	result, err = context.Eval(`Proxy = Reflect = undefined`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	more := []int{1, 2}
+	obj, err = context.WrapSlice(&more)
+	require.NoError(t, err)
+	require.NoError(t, context.Globals().Set("more", obj))
+
+	result, err = context.Eval(`more.push(3); [Array.isArray(more), more.join("|")].join()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, "true,1|2|3", result.String())
+	result.Free()
+}
+
+func TestConstructor(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	point, err := context.Constructor("Point", 2, func(ctx *Context, newTarget Value, args []Value) Value {
+		if newTarget.IsUndefined() {
+			return ctx.String("called")
+		}
+		obj, err := ctx.ObjectFromTarget(newTarget)
+		if err != nil {
+			return ctx.ThrowError(err)
+		}
+		obj.Set("x", ctx.DupValue(args[0]))
+		obj.Set("y", ctx.DupValue(args[1]))
+		return obj
+	})
+	require.NoError(t, err)
+	require.True(t, point.IsConstructor())
+	require.NoError(t, context.Globals().Set("Point", point))
+
+	result, err := context.Eval(`
+		Point.prototype.sum = function() { return this.x + this.y; };
+		class Point3 extends Point {
+			constructor(x, y, z) { super(x, y); this.z = z; }
+			sum() { return super.sum() + this.z; }
+		}
+		const p = new Point(1, 2), q = new Point3(1, 2, 3);
+		[Point(), p.sum(), q.sum(), p instanceof Point, q instanceof Point, q instanceof Point3, Point.name, Point.length].join()
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "called,3,6,true,true,true,Point,2", result.String())
+}
+
+func TestAsyncFunction(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	fetch := context.AsyncFunction(func(ctx gocontext.Context, args []interface{}) (interface{}, error) {
+		if args[0] == "fail" {
+			return nil, errors.New("not found")
+		}
+		time.Sleep(10 * time.Millisecond)
+		return map[string]interface{}{"url": args[0], "status": 200}, nil
+	})
+	require.NoError(t, context.Globals().Set("fetch", fetch))
+
+	result, err := context.Eval(`
+		var results = [];
+		fetch("a").then(r => results.push(r.url + ":" + r.status));
+		fetch("fail").catch(e => results.push(e.message));
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+	require.NoError(t, context.RunUntilIdle())
+
+	result, err = context.Eval(`results.sort().join()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "a:200,not found", result.String())
+}
+
+func TestPromise(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	promise, resolve, reject := context.NewPromise()
+	defer promise.Free()
+	defer resolve.Free()
+	defer reject.Free()
+
+	require.True(t, promise.IsPromise())
+	require.False(t, context.Object().IsPromise())
+
+	state, err := promise.PromiseState()
+	require.NoError(t, err)
+	require.EqualValues(t, PromisePending, state)
+
+	_, err = promise.PromiseResult()
+	require.True(t, errors.Is(err, ErrPromisePending))
+
+	_, err = context.Int32(1).PromiseState()
+	require.True(t, errors.Is(err, ErrNotPromise))
+
+	require.NoError(t, context.Globals().Set("p", context.DupValue(promise)))
+	doubled, err := context.Eval(`p.then(v => v * 2)`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer doubled.Free()
+
+	ret, err := context.Call(context.Undefined(), resolve, []Value{context.Int32(21)})
+	require.NoError(t, err)
+	ret.Free()
+
+	result, err := doubled.Await(gocontext.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, 42, result.Int32())
+	result.Free()
+
+	state, _ = promise.PromiseState()
+	require.EqualValues(t, PromiseFulfilled, state)
+
+	rejected, err := context.Eval(`Promise.reject(new TypeError("bad"))`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer rejected.Free()
+	_, err = rejected.Await(gocontext.Background())
+	require.Error(t, err)
+	require.EqualValues(t, "TypeError: bad", err.Error())
+
+	never, err := context.Eval(`new Promise(() => {})`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer never.Free()
+	_, err = never.Await(gocontext.Background())
+	require.True(t, errors.Is(err, ErrPromisePending))
+
+	require.NoError(t, context.Globals().Set("sleep", context.AsyncFunction(func(ctx gocontext.Context, args []interface{}) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return "done", nil
+	})))
+	async, err := context.Eval(`(async () => (await sleep()) + "!")()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer async.Free()
+	result, err = async.Await(gocontext.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, "done!", result.String())
+	result.Free()
+}
+
+// TestPromiseLayout pins the mirrored layout of the promise data, reading the
+// state and result of promises settled in every way.
+func TestPromiseLayout(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	result, err := context.Eval(`
+		globalThis.value = { answer: 42 };
+		globalThis.promises = [
+			new Promise(() => {}),
+			Promise.resolve(value),
+			Promise.reject(value),
+		];
+		promises[2].catch(() => {});
+		promises[1].then(() => {});
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	for i, want := range []PromiseState{PromisePending, PromiseFulfilled, PromiseRejected} {
+		promise, err := context.Eval(fmt.Sprintf(`promises[%d]`, i), EVAL_GLOBAL)
+		require.NoError(t, err)
+
+		state, err := promise.PromiseState()
+		require.NoError(t, err)
+		require.EqualValues(t, want, state)
+
+		settled, err := promise.PromiseResult()
+		if want == PromisePending {
+			require.True(t, errors.Is(err, ErrPromisePending))
+		} else {
+			require.NoError(t, err)
+			require.NoError(t, context.Globals().Set("settled", settled))
+			same, err := context.Eval(`settled === value`, EVAL_GLOBAL)
+			require.NoError(t, err)
+			require.True(t, same.Bool())
+		}
+		promise.Free()
+	}
+}
+
+func TestRunLoop(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	release := make(chan struct{})
+	require.NoError(t, context.Globals().Set("wait", context.AsyncFunction(func(ctx gocontext.Context, args []interface{}) (interface{}, error) {
+		<-release
+		return "released", nil
+	})))
+
+	result, err := context.Eval(`
+		var log = [];
+		wait().then(v => log.push(v));
+		os.setTimeout(() => log.push("timer"), 1);
+		Promise.resolve().then(() => log.push("job"));
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	c, cancel := gocontext.WithTimeout(gocontext.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Equal(t, gocontext.DeadlineExceeded, runtime.RunLoop(c))
+
+	close(release)
+	require.NoError(t, context.RunUntilIdle())
+
+	result, err = context.Eval(`log.join()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "job,timer,released", result.String())
+
+	// os timers run without blocking the loop, and report their exceptions
+	result, err = context.Eval(`var late = os.setTimeout(() => { throw new Error("late"); }, 1000)`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	c, cancel = gocontext.WithTimeout(gocontext.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Equal(t, gocontext.DeadlineExceeded, runtime.RunLoop(c))
+
+	result, err = context.Eval(`os.setTimeout(() => { throw new Error("boom"); }, 1)`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	c, cancel = gocontext.WithTimeout(gocontext.Background(), time.Second)
+	defer cancel()
+	err = runtime.RunLoop(c)
+	require.Error(t, err)
+	require.EqualValues(t, "Error: boom", err.Error())
+
+	result, err = context.Eval(`os.clearTimeout(late)`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+}
+
+func TestTimers(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	clock := NewManualClock(time.Unix(0, 0))
+	require.NoError(t, context.InstallTimers(clock))
+	require.Error(t, context.InstallTimers(clock))
+
+	result, err := context.Eval(`
+		var log = [];
+		setTimeout((a, b) => log.push("timeout:" + a + b), 100, "x", "y");
+		const cancelled = setTimeout(() => log.push("cancelled"), 50);
+		clearTimeout(cancelled);
+		let ticks = 0;
+		const interval = setInterval(() => {
+			log.push("tick" + (++ticks));
+			if (ticks === 3) clearInterval(interval);
+		}, 40);
+		queueMicrotask(() => log.push("micro"));
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	logged := func() string {
+		result, err := context.Eval(`log.join()`, EVAL_GLOBAL)
+		require.NoError(t, err)
+		defer result.Free()
+		return result.String()
+	}
+
+	require.NoError(t, context.RunUntilIdle())
+	require.EqualValues(t, "micro", logged())
+
+	clock.Advance(100 * time.Millisecond)
+	require.NoError(t, context.RunUntilIdle())
+	require.EqualValues(t, "micro,tick1,tick2,timeout:xy", logged())
+
+	clock.Advance(100 * time.Millisecond)
+	require.NoError(t, context.RunUntilIdle())
+	require.EqualValues(t, "micro,tick1,tick2,timeout:xy,tick3", logged())
+
+	c, cancel := gocontext.WithTimeout(gocontext.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, runtime.RunLoop(c))
+
+	result, err = context.Eval(`setTimeout(() => { throw new Error("boom"); }, 10)`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+	clock.Advance(10 * time.Millisecond)
+	err = context.RunUntilIdle()
+	require.Error(t, err)
+	require.EqualValues(t, "Error: boom", err.Error())
+
+	result, err = context.Eval(`queueMicrotask(() => { throw new RangeError("micro"); })`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+	err = context.RunUntilIdle()
+	require.Error(t, err)
+	require.EqualValues(t, "RangeError: micro", err.Error())
+}
+
+func TestPromiseRejection(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	var events []string
+	runtime.OnPromiseRejection(func(ctx *Context, promise, reason Value, handled bool) {
+		events = append(events, fmt.Sprintf("%s:%v", reason.String(), handled))
+	})
+
+	result, err := context.Eval(`var late = Promise.reject("late"); Promise.reject(new Error("lost"))`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+	result, err = context.Eval(`late.catch(() => {})`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	require.NoError(t, context.RunUntilIdle())
+	require.EqualValues(t, []string{"late:false", "Error: lost:false", "late:true"}, events)
+
+	runtime.SetStrictPromiseRejections(true)
+
+	result, err = context.Eval(`Promise.reject(new TypeError("strict")); Promise.reject(1).catch(() => {})`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+
+	err = context.RunUntilIdle()
+	require.Error(t, err)
+	var unhandled *UnhandledRejectionError
+	require.True(t, errors.As(err, &unhandled))
+	require.EqualValues(t, "unhandled promise rejection: TypeError: strict", err.Error())
+
+	require.NoError(t, context.RunUntilIdle())
+}
+
+func TestPendingJobs(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+	require.NoError(t, context.InstallTimers(nil))
+
+	require.False(t, runtime.IsJobPending())
+
+	result, err := context.Eval(`
+		var order = [];
+		Promise.resolve().then(() => order.push(1)).then(() => order.push(2));
+		queueMicrotask(() => { throw new Error("job failed"); });
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	result.Free()
+	require.True(t, runtime.IsJobPending())
+
+	n, err := runtime.RunPendingJobs(1)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+
+	n, err = runtime.RunPendingJobs(0)
+	require.EqualValues(t, 1, n)
+	var jobErr *JobError
+	require.True(t, errors.As(err, &jobErr))
+	require.True(t, jobErr.Context == context)
+	require.EqualValues(t, "Error: job failed", err.Error())
+
+	n, err = runtime.RunPendingJobs(0)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+
+	_, err = runtime.ExecutePendingJob()
+	require.Equal(t, io.EOF, err)
+
+	result, err = context.Eval(`order.join()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "1,2", result.String())
+}
+
+func TestPostAndInvoke(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	c, cancel := gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		defer cancel()
+
+		err := context.Invoke(func(ctx *Context) error {
+			return ctx.Globals().Set("answer", ctx.Int32(42))
+		})
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		failed := errors.New("failed")
+		if err := context.Invoke(func(ctx *Context) error { return failed }); err != failed {
+			errs <- fmt.Errorf("unexpected error: %v", err)
+			return
+		}
+
+		err = context.Invoke(func(ctx *Context) error { panic("boom") })
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) {
+			errs <- fmt.Errorf("unexpected error: %v", err)
+			return
+		}
+
+		posted := make(chan struct{})
+		context.Post(func(ctx *Context) {
+			result, _ := ctx.Eval(`answer += 1`, EVAL_GLOBAL)
+			result.Free()
+			close(posted)
+		})
+		<-posted
+		errs <- nil
+	}()
+
+	require.Equal(t, gocontext.Canceled, runtime.Serve(c))
+	require.NoError(t, <-errs)
+
+	result, err := context.Eval(`answer`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, 43, result.Int32())
+
+	// on the owner thread, Invoke runs fn right away
+	reentered, err := context.Bind(func(ctx *Context) (int32, error) {
+		var answer int32
+		err := ctx.Invoke(func(ctx *Context) error {
+			v := ctx.Globals().Get("answer")
+			defer v.Free()
+			answer = v.Int32()
+			return nil
+		})
+		return answer, err
+	})
+	require.NoError(t, err)
+	require.NoError(t, context.Globals().Set("reentered", reentered))
+
+	result, err = context.Eval(`reentered()`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, 43, result.Int32())
+}
+
+func TestErrorDetails(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	result, err := context.EvalFile("function fail() {\n  null.x;\n}\nfail();", EVAL_GLOBAL, "app.js")
+	result.Free()
+	require.True(t, errors.Is(err, ErrTypeError))
+	require.False(t, errors.Is(err, ErrRangeError))
+
+	var jsErr *Error
+	require.True(t, errors.As(err, &jsErr))
+	require.EqualValues(t, "TypeError", jsErr.Name)
+	require.EqualValues(t, 2, jsErr.Line)
+	require.True(t, len(jsErr.Frames) >= 2)
+	require.Equal(t, StackFrame{Function: "fail", File: "app.js", Line: 2}, jsErr.Frames[0])
+	require.EqualValues(t, 4, jsErr.Frames[1].Line)
+
+	result, err = context.EvalFile("let x = ;", EVAL_GLOBAL, "bad.js")
+	result.Free()
+	require.True(t, errors.Is(err, ErrSyntaxError))
+	require.True(t, errors.As(err, &jsErr))
+	require.EqualValues(t, "bad.js", jsErr.FileName)
+	require.EqualValues(t, 1, jsErr.Line)
+
+	result, err = context.Eval(`class MyError extends RangeError {}; throw new MyError("x")`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, ErrRangeError))
+
+	result, err = context.Eval(`throw new Error("plain")`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.As(err, &jsErr))
+	for _, class := range []error{ErrSyntaxError, ErrTypeError, ErrReferenceError, ErrRangeError, ErrInternalError, ErrAggregateError} {
+		require.False(t, errors.Is(err, class), class.Error())
+	}
+
+	result, err = context.Eval(`throw new AggregateError([new ReferenceError("a"), 1], "many")`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, ErrAggregateError))
+	require.True(t, errors.As(err, &jsErr))
+	require.Len(t, jsErr.Errors, 2)
+	require.True(t, errors.Is(jsErr.Errors[0], ErrReferenceError))
+	require.Nil(t, jsErr.Errors[1])
+
+	// classes are found without running scripts, and across contexts
+	result, err = context.Eval(`
+		var checked = false;
+		Object.defineProperty(TypeError, Symbol.hasInstance, { value: () => { checked = true; return false; } });
+		globalThis.RangeError = undefined;
+		null.x;
+	`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, ErrTypeError))
+	result, err = context.Eval(`checked`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.False(t, result.Bool())
+	result.Free()
+
+	other := runtime.NewContext()
+	defer other.Free()
+	foreign, err := other.Eval(`new RangeError("elsewhere")`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.NoError(t, context.Globals().Set("foreign", foreign))
+	result, err = context.Eval(`throw foreign`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, ErrRangeError))
+}
+
+func TestParseStack(t *testing.T) {
+	frames := parseStack("    at app.js:3\n    at fn (lib/a:b.js:10:4)\n    at push (native)\n    at <eval> (app.js:12)\n")
+	require.Equal(t, []StackFrame{
+		{File: "app.js", Line: 3},
+		{Function: "fn", File: "lib/a:b.js", Line: 10, Column: 4},
+		{Function: "push"},
+		{Function: "<eval>", File: "app.js", Line: 12},
+	}, frames)
+}
+
+type codedError struct{ code string }
+
+func (e *codedError) Error() string { return "failed with " + e.code }
+func (e *codedError) Code() string  { return e.code }
+
+func TestGoErrorRoundTrip(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	notFound := &codedError{code: "ENOENT"}
+	context.Globals().SetFunction("lookup", func(ctx *Context, this Value, args []Value) Value {
+		return ctx.ThrowError(fmt.Errorf("lookup: %w", notFound))
+	})
+
+	result, err := context.Eval(`
+		try {
+			lookup();
+		} catch (e) {
+			[e.message, e.code, e.cause.message, e.cause.code].join();
+		}
+	`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, "lookup: failed with ENOENT,ENOENT,failed with ENOENT,ENOENT", result.String())
+	result.Free()
+
+	result, err = context.Eval(`try { lookup(); } catch (e) { throw e; }`, EVAL_GLOBAL)
+	result.Free()
+	require.EqualValues(t, "Error: lookup: failed with ENOENT", err.Error())
+	require.True(t, errors.Is(err, notFound))
+
+	var jsErr *Error
+	require.True(t, errors.As(err, &jsErr))
+	require.EqualValues(t, "ENOENT", jsErr.Code)
+
+	var coded *codedError
+	require.True(t, errors.As(err, &coded))
+	require.True(t, coded == notFound)
+
+	result, err = context.Eval(`const e = new Error("js"); e.code = "EJS"; throw e`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.As(err, &jsErr))
+	require.EqualValues(t, "EJS", jsErr.Code)
+	require.Nil(t, errors.Unwrap(err))
+
+	// patched WeakMap methods neither intercept attached errors nor lose the
+	// original exception
+	result, err = context.Eval(`WeakMap.prototype.get = WeakMap.prototype.set = () => { throw {} }; lookup()`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, notFound))
+}
+
+func TestThrownValueError(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	result, err := context.Eval(`throw "oops"`, EVAL_GLOBAL)
+	result.Free()
+	var thrown *ThrownValueError
+	require.True(t, errors.As(err, &thrown))
+	require.EqualValues(t, "oops", thrown.Value)
+	require.EqualValues(t, `"oops"`, thrown.JSON)
+	require.EqualValues(t, "oops", thrown.Text)
+	require.EqualValues(t, `thrown "oops"`, err.Error())
+
+	result, err = context.Eval(`throw {code: 42, tags: ["a"]}`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.As(err, &thrown))
+	require.Equal(t, map[string]interface{}{"code": float64(42), "tags": []interface{}{"a"}}, thrown.Value)
+	require.EqualValues(t, `{"code":42,"tags":["a"]}`, thrown.JSON)
+	require.EqualValues(t, "[object Object]", thrown.Text)
+
+	result, err = context.Eval(`throw undefined`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.As(err, &thrown))
+	require.Nil(t, thrown.Value)
+	require.EqualValues(t, "", thrown.JSON)
+	require.EqualValues(t, "thrown undefined", err.Error())
+
+	result, err = context.Eval(`throw Symbol("s")`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.As(err, &thrown))
+	require.EqualValues(t, "symbol", thrown.Text)
+
+	result, err = context.Eval(`const cycle = {}; cycle.self = cycle; throw cycle`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.As(err, &thrown))
+	require.EqualValues(t, "", thrown.JSON)
+	require.Nil(t, thrown.Value)
+
+	// the value does not go through toJSON, and keeps what JSON can not hold
+	result, err = context.Eval(`throw {code: 42n, list: [1, () => 2], retry() {}, toJSON() { return "hidden"; }}`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.As(err, &thrown))
+	require.Equal(t, map[string]interface{}{"code": big.NewInt(42), "list": []interface{}{float64(1), nil}}, thrown.Value)
+	require.EqualValues(t, `"hidden"`, thrown.JSON)
+
+	result, err = context.Eval(`Promise.reject(7)`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	_, err = result.Await(gocontext.Background())
+	require.True(t, errors.As(err, &thrown))
+	require.EqualValues(t, 7, thrown.Value)
+}
+
+func TestCheck(t *testing.T) {
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	diagnostic, err := context.Check("let a = 1;\nfoo(a);", "ok.js", EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.Nil(t, diagnostic)
+
+	diagnostic, err = context.Check("let a = 1;\nlet x = ;\nfoo();", "app.js", EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.NotNil(t, diagnostic)
+	require.EqualValues(t, "app.js", diagnostic.FileName)
+	require.EqualValues(t, 2, diagnostic.Line)
+	require.EqualValues(t, 9, diagnostic.Column)
+	require.Contains(t, diagnostic.Message, "unexpected token")
+	require.EqualValues(t, "  1 | let a = 1;\n> 2 | let x = ;\n    |         ^\n  3 | foo();\n", diagnostic.Frame)
+	require.EqualValues(t, "app.js:2:9: "+diagnostic.Message+"\n"+diagnostic.Frame, diagnostic.String())
+
+	diagnostic, err = context.Check(`import { x } from "missing.js"; export const y = x;`, "mod.js", EVAL_MODULE)
+	require.NoError(t, err)
+	require.Nil(t, diagnostic)
+
+	diagnostic, err = context.Check("export const y = 1;\nexport const = 2;", "mod.js", EVAL_MODULE)
+	require.NoError(t, err)
+	require.NotNil(t, diagnostic)
+	require.EqualValues(t, 2, diagnostic.Line)
+	require.EqualValues(t, 14, diagnostic.Column)
+	require.Contains(t, diagnostic.Frame, "> 2 | export const = 2;\n    |              ^\n")
+
+	// checking does not evaluate the code
+	result, err := context.Eval(`typeof a`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "undefined", result.String())
+}
+
+func TestCodeFrame(t *testing.T) {
+	lines := []string{"a", "b", "\tbad token", "c", "d", "e"}
+	require.EqualValues(t, "  1 | a\n  2 | b\n> 3 | \tbad token\n    | \t    ^\n  4 | c\n  5 | d\n", codeFrame(lines, 3, 6))
+	require.EqualValues(t, "  1 | a\n> 2 | b\n  3 | \tbad token\n", codeFrame(lines[:3], 2, 0))
+
+	require.Equal(t, []tokenSpan{{0, 5}, {6, 7}, {8, 10}, {11, 19}, {20, 27}, {28, 32}}, lineTokens(`const x => "a \" b" /* c */ // d`))
+	require.EqualValues(t, "app.js: unexpected end of input\n", (&Diagnostic{Message: "unexpected end of input", FileName: "app.js"}).String())
+}
+
+func TestUncatchableErrors(t *testing.T) {
+	// QuickJS measures the stack of the thread which created the runtime
+	osruntime.LockOSThread()
+	defer osruntime.UnlockOSThread()
+
+	runtime := NewRuntime()
+	defer runtime.Free()
+
+	context := runtime.NewContext()
+	defer context.Free()
+
+	result, err := context.Eval(`function f() { return f() + 1; } f()`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, ErrStackOverflow))
+	require.False(t, errors.Is(err, ErrInterrupted))
+
+	interrupt := true
+	runtime.SetInterruptHandler(func() bool { return interrupt })
+
+	result, err = context.Eval(`try { for (;;) {} } catch (e) { "caught" }`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, ErrInterrupted))
+	require.False(t, errors.Is(err, ErrOutOfMemory))
+
+	// the context is usable again once the handler lets scripts run
+	interrupt = false
+	context.ResetUncatchableError()
+
+	result, err = context.Eval(`let n = 0; for (let i = 0; i < 100000; i++) n += i; n`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	require.EqualValues(t, 4999950000, result.Int64())
+	result.Free()
+
+	runtime.SetInterruptHandler(func() bool { panic("boom") })
+	result, err = context.Eval(`for (;;) {}`, EVAL_GLOBAL)
+	result.Free()
+	require.True(t, errors.Is(err, ErrInterrupted))
+
+	runtime.SetInterruptHandler(nil)
+	result, err = context.Eval(`"done"`, EVAL_GLOBAL)
+	require.NoError(t, err)
+	defer result.Free()
+	require.EqualValues(t, "done", result.String())
+
+	require.False(t, errors.Is(&Error{Cause: "InternalError: interrupted", class: ErrTypeError}, ErrInterrupted))
+
+	// scripts can not fake the conditions
+	for _, message := range []string{"out of memory", "stack overflow", "interrupted"} {
+		result, err := context.Eval(fmt.Sprintf(`throw new InternalError(%q)`, message), EVAL_GLOBAL)
+		result.Free()
+		require.True(t, errors.Is(err, ErrInternalError))
+		for _, target := range []error{ErrOutOfMemory, ErrStackOverflow, ErrInterrupted} {
+			require.False(t, errors.Is(err, target), message)
+		}
+	}
+}
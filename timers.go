@@ -0,0 +1,302 @@
+package quickjs
+
+/*
+#include "quickjs.h"
+
+static JSValue CallMicrotask(JSContext *ctx, int argc, JSValueConst *argv) {
+	return JS_Call(ctx, argv[0], JS_UNDEFINED, 0, NULL);
+}
+
+static int EnqueueMicrotask(JSContext *ctx, JSValueConst fn) {
+	return JS_EnqueueJob(ctx, CallMicrotask, 1, &fn);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock schedules the timers installed by InstallTimers.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f on any goroutine once d has elapsed.
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+type ClockTimer interface {
+	// Stop prevents the timer from firing, reporting false if it already
+	// fired or was stopped.
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer { return time.AfterFunc(d, f) }
+
+// SystemClock is the Clock of the operating system.
+var SystemClock Clock = systemClock{}
+
+// ManualClock is a Clock whose time only moves forward when advanced, which
+// makes timers deterministic in tests.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+	seq    int
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	when  time.Time
+	seq   int
+	f     func()
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	t := &manualTimer{clock: c, when: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, calling the functions of the timers
+// which become due in the order of their deadlines. Timers scheduled by these
+// functions fire as well if they are due before the new time.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			if c.timers[i].when.Equal(c.timers[j].when) {
+				return c.timers[i].seq < c.timers[j].seq
+			}
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.mu.Unlock()
+
+		t.f()
+	}
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// timerSet holds the timers created by setTimeout and setInterval.
+type timerSet struct {
+	ctx    *Context
+	loop   *eventLoop
+	clock  Clock
+	timers map[int64]*jsTimer
+	next   int64
+}
+
+type jsTimer struct {
+	id       int64
+	repeat   bool
+	interval time.Duration
+	fn       Value
+	args     []Value
+
+	// guarded by mu, since the clock fires timers on other goroutines
+	mu      sync.Mutex
+	timer   ClockTimer
+	cleared bool
+}
+
+// InstallTimers defines setTimeout, setInterval, clearTimeout, clearInterval
+// and queueMicrotask on the global object. Timers are scheduled with clock,
+// or SystemClock if it is nil, and their callbacks run in the event loop.
+func (ctx *Context) InstallTimers(clock Clock) error {
+	if ctx.timers != nil {
+		return errors.New("timers are already installed")
+	}
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	ts := &timerSet{ctx: ctx, loop: ctx.events(), clock: clock, timers: make(map[int64]*jsTimer)}
+
+	globals := ctx.Globals()
+	for name, fn := range map[string]Function{
+		"setTimeout":     ts.set(false),
+		"setInterval":    ts.set(true),
+		"clearTimeout":   ts.clear,
+		"clearInterval":  ts.clear,
+		"queueMicrotask": queueMicrotask,
+	} {
+		if err := globals.Set(name, ctx.NamedFunction(name, 1, fn)); err != nil {
+			return err
+		}
+	}
+
+	ctx.timers = ts
+	return nil
+}
+
+func (ts *timerSet) set(repeat bool) Function {
+	return func(ctx *Context, this Value, args []Value) Value {
+		if len(args) == 0 || !args[0].IsFunction() {
+			return ctx.ThrowTypeError("callback must be a function")
+		}
+
+		delay := time.Duration(0)
+		if len(args) > 1 {
+			if ms := args[1].Float64(); ms > 0 && !math.IsInf(ms, 1) {
+				delay = time.Duration(ms * float64(time.Millisecond))
+			}
+		}
+		if repeat && delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+
+		ts.next++
+		t := &jsTimer{id: ts.next, repeat: repeat, interval: delay, fn: ctx.DupValue(args[0])}
+		for i := 2; i < len(args); i++ {
+			t.args = append(t.args, ctx.DupValue(args[i]))
+		}
+		ts.timers[t.id] = t
+
+		ts.loop.addTimer()
+
+		t.mu.Lock()
+		t.timer = ts.clock.AfterFunc(delay, func() { ts.fire(t) })
+		t.mu.Unlock()
+
+		return ctx.Int64(t.id)
+	}
+}
+
+// fire runs on the clock's goroutine, queueing the callback for the owner
+// thread and rearming intervals.
+func (ts *timerSet) fire(t *jsTimer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.cleared:
+		// clear could not stop the timer, which was firing already
+		ts.loop.removeTimer()
+	case t.repeat:
+		t.timer = ts.clock.AfterFunc(t.interval, func() { ts.fire(t) })
+		ts.loop.post(func() error { return ts.run(t) })
+	default:
+		ts.loop.fireTimer(func() error { return ts.run(t) })
+	}
+}
+
+func (ts *timerSet) run(t *jsTimer) error {
+	if ts.ctx.freed() {
+		return nil
+	}
+
+	t.mu.Lock()
+	cleared := t.cleared
+	t.mu.Unlock()
+
+	if cleared {
+		return nil
+	}
+	if !t.repeat {
+		defer ts.release(t)
+	}
+
+	ret, err := ts.ctx.Call(ts.ctx.Undefined(), t.fn, t.args)
+	ret.Free()
+	return err
+}
+
+func (ts *timerSet) clear(ctx *Context, this Value, args []Value) Value {
+	if len(args) > 0 {
+		if t, ok := ts.timers[args[0].Int64()]; ok {
+			ts.stop(t)
+		}
+	}
+	return ctx.Undefined()
+}
+
+func (ts *timerSet) stop(t *jsTimer) {
+	t.mu.Lock()
+	if !t.cleared {
+		t.cleared = true
+		if t.timer.Stop() {
+			ts.loop.removeTimer()
+		}
+	}
+	t.mu.Unlock()
+
+	ts.release(t)
+}
+
+// release frees the values of a timer which will not run anymore.
+func (ts *timerSet) release(t *jsTimer) {
+	if _, ok := ts.timers[t.id]; !ok {
+		return
+	}
+	delete(ts.timers, t.id)
+
+	t.fn.Free()
+	for _, arg := range t.args {
+		arg.Free()
+	}
+}
+
+func (ts *timerSet) free() {
+	for _, t := range ts.timers {
+		ts.stop(t)
+	}
+}
+
+func queueMicrotask(ctx *Context, this Value, args []Value) Value {
+	if len(args) == 0 || !args[0].IsFunction() {
+		return ctx.ThrowTypeError("callback must be a function")
+	}
+	if C.EnqueueMicrotask(ctx.ref, args[0].ref) < 0 {
+		return ctx.ThrowInternalError("could not enqueue the microtask")
+	}
+	return ctx.Undefined()
+}
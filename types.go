@@ -0,0 +1,123 @@
+package quickjs
+
+type ValueType int
+
+const (
+	TypeUndefined ValueType = iota
+	TypeNull
+	TypeBoolean
+	TypeNumber
+	TypeBigInt
+	TypeBigFloat
+	TypeBigDecimal
+	TypeString
+	TypeSymbol
+	TypeFunction
+	TypeObject
+	TypeArray
+	TypeDate
+	TypeRegExp
+	TypePromise
+	TypeMap
+	TypeSet
+	TypeArrayBuffer
+	TypeTypedArray
+	TypeError
+	TypeProxy
+)
+
+var valueTypeNames = [...]string{
+	TypeUndefined:   "undefined",
+	TypeNull:        "null",
+	TypeBoolean:     "boolean",
+	TypeNumber:      "number",
+	TypeBigInt:      "bigint",
+	TypeBigFloat:    "bigfloat",
+	TypeBigDecimal:  "bigdecimal",
+	TypeString:      "string",
+	TypeSymbol:      "symbol",
+	TypeFunction:    "function",
+	TypeObject:      "object",
+	TypeArray:       "array",
+	TypeDate:        "date",
+	TypeRegExp:      "regexp",
+	TypePromise:     "promise",
+	TypeMap:         "map",
+	TypeSet:         "set",
+	TypeArrayBuffer: "arraybuffer",
+	TypeTypedArray:  "typedarray",
+	TypeError:       "error",
+	TypeProxy:       "proxy",
+}
+
+func (t ValueType) String() string {
+	if t < 0 || int(t) >= len(valueTypeNames) {
+		return "unknown"
+	}
+	return valueTypeNames[t]
+}
+
+// TypeOf returns what the typeof operator yields for values of this type.
+// Proxies are reported as objects, since typeof depends on their target; use
+// Value.TypeOf for those.
+func (t ValueType) TypeOf() string {
+	switch t {
+	case TypeUndefined, TypeBoolean, TypeNumber, TypeBigInt, TypeBigFloat, TypeBigDecimal, TypeString, TypeSymbol, TypeFunction:
+		return t.String()
+	default:
+		return "object"
+	}
+}
+
+// TypeOf returns what the typeof operator yields for v, which is "function"
+// for proxies of functions.
+func (v Value) TypeOf() string {
+	t := v.Type()
+	if t == TypeProxy && v.IsFunction() {
+		return "function"
+	}
+	return t.TypeOf()
+}
+
+// Type classifies v like typeof, with objects narrowed down to the most
+// specific built-in kind.
+func (v Value) Type() ValueType {
+	switch {
+	case v.IsUndefined(), v.IsUninitialized():
+		return TypeUndefined
+	case v.IsNull():
+		return TypeNull
+	case v.IsBool():
+		return TypeBoolean
+	case v.IsNumber():
+		return TypeNumber
+	case v.IsBigInt():
+		return TypeBigInt
+	case v.IsBigFloat():
+		return TypeBigFloat
+	case v.IsBigDecimal():
+		return TypeBigDecimal
+	case v.IsString():
+		return TypeString
+	case v.IsSymbol():
+		return TypeSymbol
+	case !v.IsObject():
+		return TypeUndefined
+	}
+
+	kind, ok := builtinClasses[v.classID()]
+
+	switch {
+	case ok && kind == TypeProxy:
+		return TypeProxy
+	case v.IsFunction():
+		return TypeFunction
+	case v.IsArray():
+		return TypeArray
+	case v.IsError():
+		return TypeError
+	case ok:
+		return kind
+	}
+	return TypeObject
+}
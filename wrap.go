@@ -0,0 +1,880 @@
+package quickjs
+
+/*
+#include <stdint.h>
+#include "quickjs.h"
+
+extern int exoticGetOwnProperty(JSContext *ctx, JSPropertyDescriptor *desc, JSValue obj, JSAtom prop);
+extern int exoticGetOwnPropertyNames(JSContext *ctx, JSPropertyEnum **ptab, uint32_t *plen, JSValue obj);
+extern int exoticDeleteProperty(JSContext *ctx, JSValue obj, JSAtom prop);
+extern int exoticDefineOwnProperty(JSContext *ctx, JSValue this_obj, JSAtom prop, JSValue val, JSValue getter, JSValue setter, int flags);
+extern void exoticFinalizer(JSRuntime *rt, JSValue val);
+
+static JSClassExoticMethods exotic_methods = {
+	.get_own_property = exoticGetOwnProperty,
+	.get_own_property_names = exoticGetOwnPropertyNames,
+	.delete_property = exoticDeleteProperty,
+	.define_own_property = exoticDefineOwnProperty,
+};
+
+static int RegisterExoticClass(JSContext *ctx, JSClassID class_id) {
+	JSRuntime *rt = JS_GetRuntime(ctx);
+	JSClassDef def = { .class_name = "GoObject", .finalizer = exoticFinalizer, .exotic = &exotic_methods };
+	if (JS_IsRegisteredClass(rt, class_id))
+		return 0;
+	return JS_NewClass(rt, class_id, &def);
+}
+
+static JSValue NewExoticObject(JSContext *ctx, JSValueConst proto, JSClassID class_id, int64_t id) {
+	JSValue obj = JS_NewObjectProtoClass(ctx, proto, class_id);
+	if (!JS_IsException(obj))
+		JS_SetOpaque(obj, (void *)(intptr_t)id);
+	return obj;
+}
+
+static int64_t ExoticID(JSValueConst obj, JSClassID class_id) {
+	return (int64_t)(intptr_t)JS_GetOpaque(obj, class_id);
+}
+
+static JSPropertyEnum *NewPropertyEnum(JSContext *ctx, uint32_t len) {
+	return js_mallocz(ctx, sizeof(JSPropertyEnum) * (len > 0 ? len : 1));
+}
+
+static void SetPropertyEnum(JSPropertyEnum *tab, uint32_t i, JSAtom atom) {
+	tab[i].is_enumerable = 1;
+	tab[i].atom = atom;
+}
+
+static void SetPropertyDescriptor(JSPropertyDescriptor *desc, int flags, JSValue value) {
+	desc->flags = flags;
+	desc->value = value;
+	desc->getter = JS_UNDEFINED;
+	desc->setter = JS_UNDEFINED;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	propWritable   = C.JS_PROP_WRITABLE
+	propEnumerable = C.JS_PROP_ENUMERABLE
+	propDataFlags  = propWritable | propEnumerable
+	// array elements are configurable, which the proxies of slice views
+	// must report as well
+	propElemFlags = propDataFlags | C.JS_PROP_CONFIGURABLE
+)
+
+// exoticBackend provides the own properties of an object whose state lives
+// in Go.
+type exoticBackend interface {
+	value() reflect.Value
+	keys() []string
+	lookup(ctx *Context, live *liveCache, key string) (val Value, flags int, ok bool, err error)
+	set(ctx *Context, key string, val Value) (bool, error)
+	delete(ctx *Context, key string) (bool, error)
+}
+
+type exoticObject struct {
+	backend exoticBackend
+	live    liveCache
+}
+
+var exoticClassID C.JSClassID
+
+var exoticClassOnce sync.Once
+
+// newExoticObject creates an object whose own properties are served by
+// backend, with proto as prototype.
+func (ctx *Context) newExoticObject(proto Value, backend exoticBackend) (Value, error) {
+	exoticClassOnce.Do(func() { C.JS_NewClassID(&exoticClassID) })
+
+	if C.RegisterExoticClass(ctx.ref, exoticClassID) < 0 {
+		return ctx.Undefined(), errors.New("error registering the exotic class")
+	}
+
+	id := NewObjectId(&exoticObject{backend: backend})
+
+	obj := Value{ctx: ctx, ref: C.NewExoticObject(ctx.ref, proto.ref, exoticClassID, C.int64_t(id))}
+	if obj.IsException() {
+		id.Free()
+		return obj, ctx.Exception()
+	}
+	return obj, nil
+}
+
+func exoticObjectOf(obj C.JSValue) *exoticObject {
+	if v, ok := ObjectId(C.ExoticID(obj, exoticClassID)).Get(); ok {
+		return v.(*exoticObject)
+	}
+	return nil
+}
+
+// goValue returns the Go data behind an object created by Wrap, WrapMap or
+// WrapSlice.
+func (v Value) goValue() (reflect.Value, bool) {
+	if o := exoticObjectOf(v.ref); o != nil {
+		return o.backend.value(), true
+	}
+	// slice views are proxies, with the backend attached
+	if v.classID() == classProxy {
+		if data, ok := v.attached(); ok {
+			if b, ok := data.(*sliceBackend); ok {
+				return b.value(), true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// exoticKey returns the string key of prop, or false for symbols, which Go
+// backed objects never own.
+func exoticKey(ctx *Context, prop C.JSAtom) (string, bool) {
+	atom := Atom{ctx: ctx, ref: prop}
+
+	val := atom.Value()
+	defer val.Free()
+
+	if val.IsSymbol() {
+		return "", false
+	}
+	return val.String(), true
+}
+
+// exoticThrow throws err into the context calling a hook, which may differ
+// from the one the object was created in.
+func exoticThrow(ctx *Context, err error) C.int {
+	ctx.ThrowTypeError("%v", err)
+	return -1
+}
+
+//export exoticGetOwnProperty
+func exoticGetOwnProperty(ref *C.JSContext, desc *C.JSPropertyDescriptor, obj C.JSValue, prop C.JSAtom) (result C.int) {
+	o := exoticObjectOf(obj)
+	if o == nil {
+		return 0
+	}
+
+	ctx := contextOf(ref)
+	defer catchPanic(func(r interface{}) {
+		ctx.throwPanic(r)
+		result = -1
+	})
+
+	key, ok := exoticKey(ctx, prop)
+	if !ok {
+		return 0
+	}
+
+	val, flags, ok, err := o.backend.lookup(ctx, &o.live, key)
+	if err != nil {
+		return exoticThrow(ctx, err)
+	}
+	if !ok {
+		return 0
+	}
+
+	if desc == nil {
+		val.Free()
+	} else {
+		C.SetPropertyDescriptor(desc, C.int(flags), val.ref)
+	}
+	return 1
+}
+
+//export exoticGetOwnPropertyNames
+func exoticGetOwnPropertyNames(ref *C.JSContext, ptab **C.JSPropertyEnum, plen *C.uint32_t, obj C.JSValue) (result C.int) {
+	o := exoticObjectOf(obj)
+	if o == nil {
+		*ptab, *plen = nil, 0
+		return 0
+	}
+
+	ctx := contextOf(ref)
+	defer catchPanic(func(r interface{}) {
+		ctx.throwPanic(r)
+		result = -1
+	})
+
+	keys := o.backend.keys()
+
+	tab := C.NewPropertyEnum(ref, C.uint32_t(len(keys)))
+	if tab == nil {
+		return -1
+	}
+	for i, key := range keys {
+		C.SetPropertyEnum(tab, C.uint32_t(i), ctx.Atom(key).ref)
+	}
+
+	*ptab, *plen = tab, C.uint32_t(len(keys))
+	return 0
+}
+
+//export exoticDeleteProperty
+func exoticDeleteProperty(ref *C.JSContext, obj C.JSValue, prop C.JSAtom) (result C.int) {
+	o := exoticObjectOf(obj)
+	if o == nil {
+		return 0
+	}
+
+	ctx := contextOf(ref)
+	defer catchPanic(func(r interface{}) {
+		ctx.throwPanic(r)
+		result = -1
+	})
+
+	key, ok := exoticKey(ctx, prop)
+	if !ok {
+		return 1
+	}
+
+	ok, err := o.backend.delete(ctx, key)
+	if err != nil {
+		return exoticThrow(ctx, err)
+	}
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+//export exoticDefineOwnProperty
+func exoticDefineOwnProperty(ref *C.JSContext, thisObj C.JSValue, prop C.JSAtom, val, getter, setter C.JSValue, flags C.int) (result C.int) {
+	o := exoticObjectOf(thisObj)
+	if o == nil {
+		return 0
+	}
+
+	ctx := contextOf(ref)
+	defer catchPanic(func(r interface{}) {
+		ctx.throwPanic(r)
+		result = -1
+	})
+
+	key, ok := exoticKey(ctx, prop)
+
+	switch {
+	case !ok || flags&(C.JS_PROP_HAS_GET|C.JS_PROP_HAS_SET) != 0:
+		ok = false
+	case flags&C.JS_PROP_HAS_VALUE != 0:
+		var err error
+		if ok, err = o.backend.set(ctx, key, Value{ctx: ctx, ref: val}); err != nil {
+			return exoticThrow(ctx, err)
+		}
+	default:
+		var current Value
+		if current, _, ok, _ = o.backend.lookup(ctx, &o.live, key); ok {
+			current.Free()
+		}
+	}
+
+	if ok {
+		return 1
+	}
+	if flags&C.JS_PROP_THROW != 0 {
+		return exoticThrow(ctx, fmt.Errorf("cannot define property '%s'", key))
+	}
+	return 0
+}
+
+//export exoticFinalizer
+func exoticFinalizer(rt *C.JSRuntime, val C.JSValue) {
+	id := ObjectId(C.ExoticID(val, exoticClassID))
+	if o, ok := id.Get(); ok {
+		o.(*exoticObject).live.free(rt)
+	}
+	id.Free()
+}
+
+// liveCache keeps the bound methods and nested wrappers an exotic object
+// hands out, so that reading them twice yields the same object.
+type liveCache struct {
+	entries map[string]liveEntry
+}
+
+type liveEntry struct {
+	val Value
+	id  liveID
+}
+
+func (c *liveCache) get(ctx *Context, key string, id liveID) (Value, bool) {
+	if e, ok := c.entries[key]; ok && e.id == id {
+		return ctx.DupValue(e.val), true
+	}
+	return Value{}, false
+}
+
+func (c *liveCache) put(ctx *Context, key string, val Value, id liveID) {
+	if c.entries == nil {
+		c.entries = make(map[string]liveEntry)
+	}
+	if e, ok := c.entries[key]; ok {
+		C.JS_FreeValue(ctx.ref, e.val.ref)
+	}
+	c.entries[key] = liveEntry{val: ctx.DupValue(val), id: id}
+}
+
+// value converts the field or element rv stored under key like liveValue,
+// reusing the wrapper made for the same Go data before.
+func (c *liveCache) value(ctx *Context, key string, rv reflect.Value) (Value, error) {
+	target, ok := liveData(rv)
+	if !ok {
+		return ctx.liveValue(rv)
+	}
+	return c.wrap(ctx, key, target)
+}
+
+func (c *liveCache) wrap(ctx *Context, key string, target liveTarget) (Value, error) {
+	if val, ok := c.get(ctx, key, target.id); ok {
+		return val, nil
+	}
+
+	val, err := target.wrap(ctx)
+	if err == nil {
+		c.put(ctx, key, val, target.id)
+	}
+	return val, err
+}
+
+// method binds method, once per key.
+func (c *liveCache) method(ctx *Context, key string, method reflect.Value) (Value, error) {
+	if val, ok := c.get(ctx, key, liveID{}); ok {
+		return val, nil
+	}
+
+	val, err := ctx.Bind(method.Interface())
+	if err == nil {
+		c.put(ctx, key, val, liveID{})
+	}
+	return val, err
+}
+
+func (c *liveCache) free(rt *C.JSRuntime) {
+	for _, e := range c.entries {
+		C.JS_FreeValueRT(rt, e.val.ref)
+	}
+	c.entries = nil
+}
+
+// structInfo lists the JavaScript names of the fields and methods of a
+// struct pointer type, in declaration order.
+type structInfo struct {
+	fields  []string
+	methods []string
+	index   map[string]int
+}
+
+var structInfos sync.Map
+
+func structInfoOf(t reflect.Type) *structInfo {
+	if info, ok := structInfos.Load(t); ok {
+		return info.(*structInfo)
+	}
+
+	info := &structInfo{index: make(map[string]int)}
+	for i := 0; i < t.Elem().NumField(); i++ {
+		if name, ok := fieldName(t.Elem().Field(i)); ok {
+			info.fields = append(info.fields, name)
+			info.index[name] = i
+		}
+	}
+	for i := 0; i < t.NumMethod(); i++ {
+		if name := t.Method(i).Name; !info.hasField(name) {
+			info.methods = append(info.methods, name)
+		}
+	}
+
+	structInfos.Store(t, info)
+	return info
+}
+
+func (info *structInfo) hasField(name string) bool {
+	_, ok := info.index[name]
+	return ok
+}
+
+type structBackend struct {
+	ptr  reflect.Value
+	info *structInfo
+}
+
+func (b *structBackend) field(key string) (reflect.Value, bool) {
+	if i, ok := b.info.index[key]; ok {
+		return b.ptr.Elem().Field(i), true
+	}
+	return reflect.Value{}, false
+}
+
+func (b *structBackend) method(key string) (reflect.Value, bool) {
+	if b.info.hasField(key) {
+		return reflect.Value{}, false
+	}
+	method := b.ptr.MethodByName(key)
+	return method, method.IsValid()
+}
+
+func (b *structBackend) value() reflect.Value { return b.ptr }
+
+func (b *structBackend) keys() []string {
+	keys := make([]string, 0, len(b.info.fields)+len(b.info.methods))
+	keys = append(keys, b.info.fields...)
+	return append(keys, b.info.methods...)
+}
+
+func (b *structBackend) lookup(ctx *Context, live *liveCache, key string) (Value, int, bool, error) {
+	if field, ok := b.field(key); ok {
+		val, err := live.value(ctx, key, field)
+		return val, propDataFlags, err == nil, err
+	}
+
+	if method, ok := b.method(key); ok {
+		val, err := live.method(ctx, key, method)
+		return val, 0, err == nil, err
+	}
+	return ctx.Undefined(), 0, false, nil
+}
+
+func (b *structBackend) set(ctx *Context, key string, val Value) (bool, error) {
+	field, ok := b.field(key)
+	if !ok {
+		return false, nil
+	}
+
+	rv, err := val.storedValue(field.Type())
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	old := reflect.ValueOf(field.Interface())
+	field.Set(rv)
+	releaseStored(ctx, old)
+	return true, nil
+}
+
+func (b *structBackend) delete(ctx *Context, key string) (bool, error) {
+	_, isField := b.field(key)
+	_, isMethod := b.method(key)
+	return !isField && !isMethod, nil
+}
+
+// liveValue converts a field or element to JavaScript, wrapping nested
+// structs, maps and slices so that they stay live as well.
+func (ctx *Context) liveValue(rv reflect.Value) (Value, error) {
+	if target, ok := liveData(rv); ok {
+		return target.wrap(ctx)
+	}
+	if rv.Kind() == reflect.Interface && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Type() == valueType {
+		return ctx.DupValue(rv.Interface().(Value)), nil
+	}
+	return ctx.toJS(rv)
+}
+
+// liveTarget is Go data which liveValue wraps rather than converts.
+type liveTarget struct {
+	id   liveID
+	wrap func(ctx *Context) (Value, error)
+}
+
+// liveID identifies the Go data behind a wrapper: a pointer to a struct, a
+// map, or the place a slice is kept in.
+type liveID struct {
+	t reflect.Type
+	p uintptr
+}
+
+func liveData(rv reflect.Value) (liveTarget, bool) {
+	switch {
+	case rv.Kind() == reflect.Interface && !rv.IsNil():
+		if rv.CanAddr() && rv.Elem().Kind() == reflect.Slice {
+			return sliceTarget(addressSlot(rv, rv.Elem().Type()), rv.Addr().Pointer()), true
+		}
+		return liveData(rv.Elem())
+	case rv.Kind() == reflect.Struct && rv.CanAddr() && rv.Type() != bigFltType.Elem() && rv.Type() != bigIntType.Elem():
+		return structTarget(rv.Addr()), true
+	case rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Struct && rv.Type() != bigFltType && rv.Type() != bigIntType:
+		return structTarget(rv), true
+	case rv.Kind() == reflect.Map && !rv.IsNil() && rv.Type().Key().Kind() == reflect.String:
+		return liveTarget{
+			id:   liveID{t: rv.Type(), p: rv.Pointer()},
+			wrap: func(ctx *Context) (Value, error) { return ctx.wrapMap(rv) },
+		}, true
+	case rv.Kind() == reflect.Slice && rv.CanAddr():
+		return sliceTarget(addressSlot(rv, rv.Type()), rv.Addr().Pointer()), true
+	}
+	return liveTarget{}, false
+}
+
+func structTarget(ptr reflect.Value) liveTarget {
+	return liveTarget{
+		id:   liveID{t: ptr.Type(), p: ptr.Pointer()},
+		wrap: func(ctx *Context) (Value, error) { return ctx.Wrap(ptr.Interface()) },
+	}
+}
+
+func sliceTarget(slot sliceSlot, p uintptr) liveTarget {
+	return liveTarget{
+		id:   liveID{t: slot.t, p: p},
+		wrap: func(ctx *Context) (Value, error) { return ctx.wrapSlice(slot) },
+	}
+}
+
+// storedValue converts v for storing into Go data, which keeps its own
+// references to the Values in it until they are overwritten or deleted. The
+// references are recorded, so that releaseStored frees only those.
+func (v Value) storedValue(t reflect.Type) (reflect.Value, error) {
+	if t == valueType {
+		v = v.ctx.DupValue(v)
+		v.ctx.store(v)
+		return reflect.ValueOf(v), nil
+	}
+
+	var elems []Value
+	end := v.ctx.borrow(&elems)
+	defer end()
+
+	rv, err := v.toGo(t)
+	if err != nil {
+		return rv, err
+	}
+	for _, elem := range elems {
+		v.ctx.store(elem)
+	}
+	return rv, nil
+}
+
+func (ctx *Context) store(v Value) {
+	if ctx.stored == nil {
+		ctx.stored = make(map[C.JSValue]int)
+	}
+	ctx.stored[v.ref]++
+}
+
+// releaseStored frees the Values held by rv which storedValue converted, once
+// rv has been overwritten or deleted. Values put into the data by Go code are
+// left to it. Pointers are not followed, since they lead to data owned
+// elsewhere.
+func releaseStored(ctx *Context, rv reflect.Value) {
+	switch rv.Kind() {
+	case reflect.Interface:
+		if !rv.IsNil() {
+			releaseStored(ctx, rv.Elem())
+		}
+	case reflect.Struct:
+		if rv.Type() != valueType {
+			return
+		}
+		ref := rv.Interface().(Value).ref
+		n, ok := ctx.stored[ref]
+		if !ok {
+			return
+		}
+		if n > 1 {
+			ctx.stored[ref] = n - 1
+		} else {
+			delete(ctx.stored, ref)
+		}
+		C.JS_FreeValue(ctx.ref, ref)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			releaseStored(ctx, rv.Index(i))
+		}
+	case reflect.Map:
+		iter := rv.MapRange()
+		for iter.Next() {
+			releaseStored(ctx, iter.Value())
+		}
+	}
+}
+
+// Wrap exposes the struct ptr points to as a JavaScript object whose
+// properties read and write the exported fields directly, named after their
+// `js` or `json` tags. Methods of ptr are callable as non-enumerable
+// properties. The struct is kept alive until the object is collected.
+//
+// Values written into wrapped data from JavaScript belong to it: they are
+// freed when overwritten or deleted from JavaScript, and otherwise by the
+// owner of the data. Values put into the data by Go code stay owned by it.
+func (ctx *Context) Wrap(ptr interface{}) (Value, error) {
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ctx.Undefined(), errors.New("wrap: value must be a non-nil pointer to a struct")
+	}
+
+	proto := ctx.intrinsic("Object.prototype")
+	defer proto.Free()
+
+	return ctx.newExoticObject(proto, &structBackend{ptr: rv, info: structInfoOf(rv.Type())})
+}
+
+type mapBackend struct {
+	m reflect.Value
+}
+
+func (b *mapBackend) key(key string) reflect.Value {
+	return reflect.ValueOf(key).Convert(b.m.Type().Key())
+}
+
+func (b *mapBackend) value() reflect.Value { return b.m }
+
+func (b *mapBackend) keys() []string {
+	keys := make([]string, 0, b.m.Len())
+	for _, key := range b.m.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *mapBackend) lookup(ctx *Context, live *liveCache, key string) (Value, int, bool, error) {
+	elem := b.m.MapIndex(b.key(key))
+	if !elem.IsValid() {
+		return ctx.Undefined(), 0, false, nil
+	}
+
+	// map entries are not addressable, so slices are wrapped through the
+	// entry to stay live
+	if slice := elem; slice.Kind() == reflect.Interface && !slice.IsNil() || slice.Kind() == reflect.Slice {
+		if slice.Kind() == reflect.Interface {
+			slice = slice.Elem()
+		}
+		if slice.Kind() == reflect.Slice {
+			val, err := live.wrap(ctx, key, sliceTarget(b.entrySlot(key, slice.Type()), b.m.Pointer()))
+			return val, propDataFlags, err == nil, err
+		}
+	}
+
+	val, err := live.value(ctx, key, elem)
+	return val, propDataFlags, err == nil, err
+}
+
+// entrySlot keeps a slice of type t in the entry key.
+func (b *mapBackend) entrySlot(key string, t reflect.Type) sliceSlot {
+	return sliceSlot{
+		t:     t,
+		load:  func() reflect.Value { return b.m.MapIndex(b.key(key)) },
+		store: func(slice reflect.Value) { b.m.SetMapIndex(b.key(key), slice) },
+	}
+}
+
+func (b *mapBackend) set(ctx *Context, key string, val Value) (bool, error) {
+	elem, err := val.storedValue(b.m.Type().Elem())
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	old := b.m.MapIndex(b.key(key))
+	b.m.SetMapIndex(b.key(key), elem)
+	releaseStored(ctx, old)
+	return true, nil
+}
+
+func (b *mapBackend) delete(ctx *Context, key string) (bool, error) {
+	old := b.m.MapIndex(b.key(key))
+	b.m.SetMapIndex(b.key(key), reflect.Value{})
+	releaseStored(ctx, old)
+	return true, nil
+}
+
+func (ctx *Context) wrapMap(m reflect.Value) (Value, error) {
+	proto := ctx.intrinsic("Object.prototype")
+	defer proto.Free()
+
+	return ctx.newExoticObject(proto, &mapBackend{m: m})
+}
+
+// WrapMap exposes m as a JavaScript object whose properties read, write and
+// delete the entries of m directly. Keys are enumerated in sorted order.
+func (ctx *Context) WrapMap(m map[string]interface{}) (Value, error) {
+	if m == nil {
+		return ctx.Undefined(), errors.New("wrap: map must not be nil")
+	}
+	return ctx.wrapMap(reflect.ValueOf(m))
+}
+
+// sliceSlot is where a wrapped slice is kept, so that it can be replaced
+// when it grows. An empty slice is loaded once the slot holds anything else.
+type sliceSlot struct {
+	t     reflect.Type
+	load  func() reflect.Value
+	store func(slice reflect.Value)
+}
+
+// addressSlot keeps a slice of type t in rv, an addressable slice or
+// interface.
+func addressSlot(rv reflect.Value, t reflect.Type) sliceSlot {
+	return sliceSlot{
+		t:     t,
+		load:  func() reflect.Value { return rv },
+		store: func(slice reflect.Value) { rv.Set(slice) },
+	}
+}
+
+type sliceBackend struct {
+	slot sliceSlot
+}
+
+func (b *sliceBackend) slice() reflect.Value {
+	slice := b.slot.load()
+	if slice.Kind() == reflect.Interface && !slice.IsNil() {
+		slice = slice.Elem()
+	}
+	if !slice.IsValid() || slice.Type() != b.slot.t {
+		return reflect.MakeSlice(b.slot.t, 0, 0)
+	}
+	return slice
+}
+
+func (b *sliceBackend) value() reflect.Value { return b.slice() }
+
+// index parses key as an array index.
+func (b *sliceBackend) index(key string) (int, bool) {
+	i, err := strconv.ParseUint(key, 10, 32)
+	if err != nil || strconv.FormatUint(i, 10) != key {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// resize changes the length of the slice, filling new elements with zero
+// values and releasing removed ones.
+func (b *sliceBackend) resize(ctx *Context, n int) {
+	slice := b.slice()
+	if n <= slice.Len() {
+		for i := n; i < slice.Len(); i++ {
+			elem := slice.Index(i)
+			old := reflect.ValueOf(elem.Interface())
+			elem.Set(reflect.Zero(elem.Type()))
+			releaseStored(ctx, old)
+		}
+		b.slot.store(slice.Slice(0, n))
+		return
+	}
+	b.slot.store(reflect.AppendSlice(slice, reflect.MakeSlice(slice.Type(), n-slice.Len(), n-slice.Len())))
+}
+
+func (b *sliceBackend) keys() []string {
+	slice := b.slice()
+	keys := make([]string, 0, slice.Len()+1)
+	for i := 0; i < slice.Len(); i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	return append(keys, "length")
+}
+
+func (b *sliceBackend) lookup(ctx *Context, live *liveCache, key string) (Value, int, bool, error) {
+	slice := b.slice()
+	if key == "length" {
+		return ctx.Int64(int64(slice.Len())), propWritable, true, nil
+	}
+	if i, ok := b.index(key); ok && i < slice.Len() {
+		val, err := live.value(ctx, key, slice.Index(i))
+		return val, propElemFlags, err == nil, err
+	}
+	return ctx.Undefined(), 0, false, nil
+}
+
+func (b *sliceBackend) set(ctx *Context, key string, val Value) (bool, error) {
+	if key == "length" {
+		n, err := val.integer()
+		if err != nil || n.Sign() < 0 || !n.IsInt64() || n.Int64() > math.MaxUint32 {
+			return false, errors.New("invalid array length")
+		}
+		b.resize(ctx, int(n.Int64()))
+		return true, nil
+	}
+
+	i, ok := b.index(key)
+	if !ok {
+		return false, nil
+	}
+
+	elem, err := val.storedValue(b.slot.t.Elem())
+	if err != nil {
+		return false, fmt.Errorf("[%d]: %w", i, err)
+	}
+	if i >= b.slice().Len() {
+		b.resize(ctx, i+1)
+	}
+	target := b.slice().Index(i)
+	old := reflect.ValueOf(target.Interface())
+	target.Set(elem)
+	releaseStored(ctx, old)
+	return true, nil
+}
+
+func (b *sliceBackend) delete(ctx *Context, key string) (bool, error) {
+	if key == "length" {
+		return false, nil
+	}
+	// slices have no holes, so deleting an element resets it to its zero value
+	if i, ok := b.index(key); ok && i < b.slice().Len() {
+		elem := b.slice().Index(i)
+		old := reflect.ValueOf(elem.Interface())
+		elem.Set(reflect.Zero(elem.Type()))
+		releaseStored(ctx, old)
+	}
+	return true, nil
+}
+
+// wrapSlice creates a view of the slice in slot: a proxy of an array, so
+// that Array.isArray reports true, forwarding to an exotic object serving
+// the elements.
+func (ctx *Context) wrapSlice(slot sliceSlot) (Value, error) {
+	newProxy, err := ctx.helper("sliceProxy", `(Proxy, { get, set, has, deleteProperty, ownKeys, getOwnPropertyDescriptor, defineProperty }, view) => new Proxy([], {
+		get: (target, key, receiver) => get(view, key, receiver),
+		set: (target, key, value) => set(view, key, value),
+		has: (target, key) => has(view, key),
+		deleteProperty: (target, key) => deleteProperty(view, key),
+		ownKeys: () => ownKeys(view),
+		getOwnPropertyDescriptor: (target, key) => getOwnPropertyDescriptor(view, key),
+		defineProperty: (target, key, desc) => defineProperty(view, key, desc),
+	})`)
+	if err != nil {
+		return newProxy, err
+	}
+
+	proto := ctx.intrinsic("Array.prototype")
+	defer proto.Free()
+
+	backend := &sliceBackend{slot: slot}
+
+	view, err := ctx.newExoticObject(proto, backend)
+	if err != nil {
+		return view, err
+	}
+	defer view.Free()
+
+	proxyCtor, reflectObj := ctx.intrinsic("Proxy"), ctx.intrinsic("Reflect")
+	defer proxyCtor.Free()
+	defer reflectObj.Free()
+
+	proxy, err := ctx.Call(ctx.Undefined(), newProxy, []Value{proxyCtor, reflectObj, view})
+	if err != nil {
+		return proxy, err
+	}
+	if err := ctx.attach(proxy, backend); err != nil {
+		proxy.Free()
+		return ctx.Undefined(), err
+	}
+	return proxy, nil
+}
+
+// WrapSlice exposes the slice ptr points to as a JavaScript array, a proxy
+// whose index and length writes update the slice in place, growing it with
+// zero values as needed.
+func (ctx *Context) WrapSlice(ptr interface{}) (Value, error) {
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return ctx.Undefined(), errors.New("wrap: value must be a non-nil pointer to a slice")
+	}
+	return ctx.wrapSlice(addressSlot(rv.Elem(), rv.Elem().Type()))
+}